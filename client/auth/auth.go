@@ -0,0 +1,228 @@
+// Package auth Signs the messages an agency sends to the central with an
+// HMAC-SHA256 keyed by a secret shared between them, and verifies them on
+// the central side.
+//
+// A signed message is a protocol.MsgSigned message whose payload is the
+// agency id (4 bytes), a message sequence number (8 bytes), a unix
+// timestamp in milliseconds (8 bytes), the signature and the serialized
+// signed message. The signature covers everything before it and the signed
+// message, so neither the agency nor the message can be changed, and the
+// timestamp and sequence number let the central drop replayed messages.
+// server/common/auth.py is the reference implementation of the verifier for
+// the central, checked against the same test vectors
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+const (
+	agencySize    = 4
+	seqSize       = 8
+	timestampSize = 8
+	headerSize    = agencySize + seqSize + timestampSize
+	// SignatureSize Size in bytes of the signature of a message
+	SignatureSize = sha256.Size
+	// Overhead Bytes a signed message takes on top of the message it signs
+	Overhead = protocol.MessageHeaderSize + headerSize + SignatureSize
+)
+
+// DefaultWindow Default maximum difference between the timestamp of a
+// message and the clock of the central
+const DefaultWindow = 30 * time.Second
+
+var (
+	// ErrUnknownAgency The agency of the message has no secret
+	ErrUnknownAgency = errors.New("unknown agency")
+	// ErrBadSignature The signature does not match the message
+	ErrBadSignature = errors.New("bad signature")
+	// ErrStale The timestamp of the message is out of the window
+	ErrStale = errors.New("stale message")
+	// ErrReplayed The message was already verified
+	ErrReplayed = errors.New("replayed message")
+)
+
+// LoadSecret Reads a shared secret from the file received as parameter,
+// ignoring surrounding whitespace. An empty secret is an error
+func LoadSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read secret")
+	}
+	secret := bytes.TrimSpace(data)
+	if len(secret) == 0 {
+		return nil, errors.Errorf("secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// Envelope A verified message and the data it was signed with
+type Envelope struct {
+	Agency    uint32
+	Seq       uint64
+	Timestamp time.Time
+	Message   protocol.Message
+}
+
+// Signer Signs the messages of an agency, numbering them from 1. It can be
+// used from several goroutines
+type Signer struct {
+	agency uint32
+	secret []byte
+	now    func() time.Time
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+// NewSigner Initializes a signer for the agency received as parameter
+func NewSigner(agency uint32, secret []byte) *Signer {
+	return &Signer{agency: agency, secret: secret, now: time.Now}
+}
+
+// Sign Returns the message wrapped in a signed message
+func (s *Signer) Sign(message protocol.Message) protocol.Message {
+	s.mu.Lock()
+	s.seq++
+	seq := s.seq
+	s.mu.Unlock()
+
+	signed := message.Serialize()
+	payload := make([]byte, headerSize, headerSize+SignatureSize+len(signed))
+	binary.BigEndian.PutUint32(payload[:agencySize], s.agency)
+	binary.BigEndian.PutUint64(payload[agencySize:agencySize+seqSize], seq)
+	binary.BigEndian.PutUint64(payload[agencySize+seqSize:headerSize], uint64(s.now().UnixNano()/int64(time.Millisecond)))
+	payload = append(payload, signature(s.secret, payload, signed)...)
+	payload = append(payload, signed...)
+	return protocol.NewMessage(protocol.MsgSigned, payload)
+}
+
+// signature HMAC-SHA256 of the header and the signed message
+func signature(secret []byte, header []byte, signed []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(header)
+	mac.Write(signed)
+	return mac.Sum(nil)
+}
+
+// replayKey Identifies a message among the ones verified within the window
+type replayKey struct {
+	agency    uint32
+	seq       uint64
+	timestamp uint64
+}
+
+// seenMessage A verified message, kept to reject replays of it
+type seenMessage struct {
+	key       replayKey
+	timestamp time.Time
+}
+
+// Verifier Verifies signed messages on the central side. Messages whose
+// timestamp differs from the clock of the central in more than the window
+// are rejected, and so are messages already verified within it. It can be
+// used from several goroutines
+type Verifier struct {
+	secrets map[uint32][]byte
+	window  time.Duration
+	now     func() time.Time
+
+	mu   sync.Mutex
+	seen map[replayKey]struct{}
+	// order Verified messages in the order they were verified, so the ones
+	// that left the window are forgotten from the oldest without going over
+	// the rest
+	order []seenMessage
+}
+
+// NewVerifier Initializes a verifier with the secret of every agency. A
+// non positive window uses DefaultWindow
+func NewVerifier(secrets map[uint32][]byte, window time.Duration) *Verifier {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	return &Verifier{
+		secrets: secrets,
+		window:  window,
+		now:     time.Now,
+		seen:    make(map[replayKey]struct{}),
+	}
+}
+
+// Verify Checks the signed message received as parameter and returns the
+// message it carries. The carried message keeps its payload as it was sent,
+// so a compressed payload must still be inflated
+func (v *Verifier) Verify(message protocol.Message) (Envelope, error) {
+	if message.Kind != protocol.MsgSigned {
+		return Envelope{}, errors.Wrapf(ErrBadSignature, "%v message is not signed", message.Kind)
+	}
+	payload := message.Payload
+	if len(payload) < headerSize+SignatureSize {
+		return Envelope{}, &protocol.MalformedMessageError{
+			Reason: fmt.Sprintf("signed message takes %d bytes, expected at least %d", len(payload), headerSize+SignatureSize),
+		}
+	}
+
+	header := payload[:headerSize]
+	key := replayKey{
+		agency:    binary.BigEndian.Uint32(header[:agencySize]),
+		seq:       binary.BigEndian.Uint64(header[agencySize : agencySize+seqSize]),
+		timestamp: binary.BigEndian.Uint64(header[agencySize+seqSize:]),
+	}
+	secret, ok := v.secrets[key.agency]
+	if !ok {
+		return Envelope{}, errors.Wrapf(ErrUnknownAgency, "agency %d", key.agency)
+	}
+	signed := payload[headerSize+SignatureSize:]
+	if !hmac.Equal(payload[headerSize:headerSize+SignatureSize], signature(secret, header, signed)) {
+		return Envelope{}, errors.Wrapf(ErrBadSignature, "message %d of agency %d", key.seq, key.agency)
+	}
+
+	timestamp := time.Unix(0, int64(key.timestamp)*int64(time.Millisecond))
+	if err := v.remember(key, timestamp); err != nil {
+		return Envelope{}, err
+	}
+
+	inner, err := protocol.DeserializeMessage(signed)
+	if err != nil {
+		return Envelope{}, err
+	}
+	return Envelope{Agency: key.agency, Seq: key.seq, Timestamp: timestamp, Message: inner}, nil
+}
+
+// remember Records the message as verified, failing if its timestamp is
+// out of the window or it was already verified. Messages that left the
+// window are forgotten, since their timestamp alone rejects them. They are
+// forgotten in the order they were verified, so a message is kept until the
+// ones verified before it leave the window too, at most twice the window
+func (v *Verifier) remember(key replayKey, timestamp time.Time) error {
+	now := v.now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for len(v.order) > 0 && now.Sub(v.order[0].timestamp) > v.window {
+		delete(v.seen, v.order[0].key)
+		v.order = v.order[1:]
+	}
+
+	skew := now.Sub(timestamp)
+	if skew > v.window || skew < -v.window {
+		return errors.Wrapf(ErrStale, "message %d of agency %d is %v away from now", key.seq, key.agency, skew)
+	}
+	if _, ok := v.seen[key]; ok {
+		return errors.Wrapf(ErrReplayed, "message %d of agency %d", key.seq, key.agency)
+	}
+	v.seen[key] = struct{}{}
+	v.order = append(v.order, seenMessage{key: key, timestamp: timestamp})
+	return nil
+}
@@ -0,0 +1,256 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+var testSecret = []byte("agency-secret")
+
+// newTestPair Signer of agency 1 and a verifier that knows its secret,
+// both with the clock received as parameter
+func newTestPair(now func() time.Time) (*Signer, *Verifier) {
+	signer := NewSigner(1, testSecret)
+	signer.now = now
+	verifier := NewVerifier(map[uint32][]byte{1: testSecret}, time.Minute)
+	verifier.now = now
+	return signer, verifier
+}
+
+func fixedClock(t time.Time) func() time.Time {
+	return func() time.Time { return t }
+}
+
+func TestVerifyReturnsSignedMessage(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signer, verifier := newTestPair(fixedClock(now))
+	message := protocol.NewMessage(protocol.MsgBatchBet, []byte("bets"))
+
+	signer.Sign(message)
+	envelope, err := verifier.Verify(signer.Sign(message))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if envelope.Agency != 1 || envelope.Seq != 2 || !envelope.Timestamp.Equal(now) {
+		t.Fatalf("unexpected envelope %+v", envelope)
+	}
+	if envelope.Message.Kind != message.Kind || !bytes.Equal(envelope.Message.Payload, message.Payload) {
+		t.Fatalf("expected %+v, got %+v", message, envelope.Message)
+	}
+}
+
+func TestVerifyRejectsTamperedMessages(t *testing.T) {
+	signer, verifier := newTestPair(time.Now)
+	signed := signer.Sign(protocol.NewMessage(protocol.MsgBatchBet, []byte("bets")))
+
+	for name, offset := range map[string]int{
+		"agency":    0,
+		"seq":       agencySize,
+		"timestamp": headerSize - 1,
+		"message":   len(signed.Payload) - 1,
+	} {
+		tampered := append([]byte(nil), signed.Payload...)
+		tampered[offset] ^= 1
+		_, err := verifier.Verify(protocol.NewMessage(protocol.MsgSigned, tampered))
+		if !errors.Is(err, ErrBadSignature) && !errors.Is(err, ErrUnknownAgency) {
+			t.Fatalf("expected a tampered %s to be rejected, got %v", name, err)
+		}
+	}
+
+	other := NewSigner(1, []byte("another secret"))
+	if _, err := verifier.Verify(other.Sign(protocol.NewMessage(protocol.MsgBatchBet, nil))); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("expected a message signed with another secret to be rejected, got %v", err)
+	}
+}
+
+func TestVerifyRejectsReplayedAndStaleMessages(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signer, verifier := newTestPair(func() time.Time { return now })
+	signed := signer.Sign(protocol.NewMessage(protocol.MsgAgencyFinished, nil))
+
+	if _, err := verifier.Verify(signed); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := verifier.Verify(signed); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("expected the message to be rejected as replayed, got %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, err := verifier.Verify(signed); !errors.Is(err, ErrStale) {
+		t.Fatalf("expected the message to be rejected as stale, got %v", err)
+	}
+	if len(verifier.seen) != 0 {
+		t.Fatalf("expected messages out of the window to be forgotten, %d remain", len(verifier.seen))
+	}
+}
+
+func TestVerifyForgetsOnlyMessagesOutOfTheWindow(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signer, verifier := newTestPair(func() time.Time { return now })
+	old := signer.Sign(protocol.NewMessage(protocol.MsgAgencyFinished, nil))
+	if _, err := verifier.Verify(old); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now = now.Add(40 * time.Second)
+	recent := signer.Sign(protocol.NewMessage(protocol.MsgAgencyFinished, nil))
+	if _, err := verifier.Verify(recent); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now = now.Add(40 * time.Second)
+	if _, err := verifier.Verify(recent); !errors.Is(err, ErrReplayed) {
+		t.Fatalf("expected the recent message to be rejected as replayed, got %v", err)
+	}
+	if len(verifier.seen) != 1 || len(verifier.order) != 1 {
+		t.Fatalf("expected only the recent message to be remembered, got %d", len(verifier.seen))
+	}
+}
+
+// vectorsPath Signed messages shared with the tests of the reference
+// verifier of the central
+const vectorsPath = "../../server/tests/auth_vectors.json"
+
+// vectorErrors Error returned for every failed result of the vectors
+var vectorErrors = map[string]error{
+	"unknown_agency": ErrUnknownAgency,
+	"bad_signature":  ErrBadSignature,
+	"stale":          ErrStale,
+}
+
+type testVectors struct {
+	Secrets  map[string]string `json:"secrets"`
+	WindowMs int64             `json:"window_ms"`
+	Vectors  []struct {
+		Name        string `json:"name"`
+		NowMs       int64  `json:"now_ms"`
+		Message     string `json:"message"`
+		Result      string `json:"result"`
+		Agency      uint32 `json:"agency"`
+		Seq         uint64 `json:"seq"`
+		TimestampMs int64  `json:"timestamp_ms"`
+		Inner       string `json:"inner"`
+	} `json:"vectors"`
+}
+
+func loadTestVectors(t *testing.T) testVectors {
+	t.Helper()
+	data, err := os.ReadFile(vectorsPath)
+	if err != nil {
+		t.Fatalf("could not read vectors: %v", err)
+	}
+	var vectors testVectors
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatalf("could not decode vectors: %v", err)
+	}
+	return vectors
+}
+
+func decodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("could not decode %q: %v", s, err)
+	}
+	return data
+}
+
+func millis(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func TestVerifyMatchesSharedVectors(t *testing.T) {
+	vectors := loadTestVectors(t)
+	secrets := make(map[uint32][]byte)
+	for agency, secret := range vectors.Secrets {
+		id, err := strconv.ParseUint(agency, 10, 32)
+		if err != nil {
+			t.Fatalf("invalid agency %q", agency)
+		}
+		secrets[uint32(id)] = []byte(secret)
+	}
+
+	for _, vector := range vectors.Vectors {
+		t.Run(vector.Name, func(t *testing.T) {
+			verifier := NewVerifier(secrets, time.Duration(vectors.WindowMs)*time.Millisecond)
+			verifier.now = fixedClock(millis(vector.NowMs))
+			message, err := protocol.DeserializeMessage(decodeHex(t, vector.Message))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			envelope, err := verifier.Verify(message)
+			switch vector.Result {
+			case "ok":
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if envelope.Agency != vector.Agency || envelope.Seq != vector.Seq || !envelope.Timestamp.Equal(millis(vector.TimestampMs)) {
+					t.Fatalf("unexpected envelope %+v", envelope)
+				}
+				if inner := envelope.Message.Serialize(); !bytes.Equal(inner, decodeHex(t, vector.Inner)) {
+					t.Fatalf("expected message %s, got %x", vector.Inner, inner)
+				}
+			case "malformed":
+				var malformed *protocol.MalformedMessageError
+				if !errors.As(err, &malformed) {
+					t.Fatalf("expected *protocol.MalformedMessageError, got %v", err)
+				}
+			default:
+				if !errors.Is(err, vectorErrors[vector.Result]) {
+					t.Fatalf("expected %v, got %v", vectorErrors[vector.Result], err)
+				}
+			}
+		})
+	}
+}
+
+func TestSignMatchesSharedVectors(t *testing.T) {
+	vectors := loadTestVectors(t)
+	for _, vector := range vectors.Vectors {
+		if vector.Result != "ok" {
+			continue
+		}
+		t.Run(vector.Name, func(t *testing.T) {
+			inner, err := protocol.DeserializeMessage(decodeHex(t, vector.Inner))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			signer := NewSigner(vector.Agency, []byte(vectors.Secrets[strconv.FormatUint(uint64(vector.Agency), 10)]))
+			signer.now = fixedClock(millis(vector.TimestampMs))
+			signer.seq = vector.Seq - 1
+
+			if signed := signer.Sign(inner).Serialize(); !bytes.Equal(signed, decodeHex(t, vector.Message)) {
+				t.Fatalf("expected %s, got %x", vector.Message, signed)
+			}
+		})
+	}
+}
+
+func TestLoadSecretTrimsWhitespace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("  agency-secret\n"), 0600); err != nil {
+		t.Fatalf("could not write secret: %v", err)
+	}
+	secret, err := LoadSecret(path)
+	if err != nil || !bytes.Equal(secret, testSecret) {
+		t.Fatalf("expected %q, got %q, %v", testSecret, secret, err)
+	}
+
+	if err := os.WriteFile(path, []byte("\n"), 0600); err != nil {
+		t.Fatalf("could not write secret: %v", err)
+	}
+	if _, err := LoadSecret(path); err == nil {
+		t.Fatal("expected an error for an empty secret")
+	}
+}
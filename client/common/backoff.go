@@ -0,0 +1,71 @@
+package common
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// DefaultBackoffJitter Fraction of every delay that is randomized
+const DefaultBackoffJitter = 0.2
+
+// Backoff Exponential backoff with jitter. Every call to Next doubles the
+// base delay until max is reached, and the returned delay is randomized by
+// up to a jitter fraction of the base delay in either direction
+type Backoff struct {
+	initial time.Duration
+	max     time.Duration
+	jitter  float64
+	current time.Duration
+}
+
+// NewBackoff Initializes a backoff that starts waiting initial and never
+// waits more than max (plus jitter)
+func NewBackoff(initial time.Duration, max time.Duration, jitter float64) *Backoff {
+	if max < initial {
+		max = initial
+	}
+	return &Backoff{
+		initial: initial,
+		max:     max,
+		jitter:  jitter,
+		current: initial,
+	}
+}
+
+// Next Returns the delay to wait before the next attempt
+func (b *Backoff) Next() time.Duration {
+	delay := b.current
+	b.current *= 2
+	if b.current > b.max || b.current <= 0 {
+		b.current = b.max
+	}
+
+	if b.jitter > 0 {
+		spread := float64(delay) * b.jitter
+		delay += time.Duration(spread * (2*rand.Float64() - 1))
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	return delay
+}
+
+// Reset Makes the next delay be the initial one again
+func (b *Backoff) Reset() {
+	b.current = b.initial
+}
+
+// sleepContext Waits the duration received as parameter unless the context
+// is done first, in which case the context error is returned
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDoublesUntilMax(t *testing.T) {
+	backoff := NewBackoff(100*time.Millisecond, time.Second, 0)
+
+	expected := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for i, delay := range expected {
+		if next := backoff.Next(); next != delay {
+			t.Fatalf("expected delay %d to be %v, got %v", i, delay, next)
+		}
+	}
+
+	backoff.Reset()
+	if next := backoff.Next(); next != 100*time.Millisecond {
+		t.Fatalf("expected the initial delay after a reset, got %v", next)
+	}
+}
+
+func TestBackoffJitterStaysWithinFraction(t *testing.T) {
+	backoff := NewBackoff(time.Second, time.Second, 0.2)
+	for i := 0; i < 100; i++ {
+		if next := backoff.Next(); next < 800*time.Millisecond || next > 1200*time.Millisecond {
+			t.Fatalf("expected a delay within 20%% of 1s, got %v", next)
+		}
+	}
+}
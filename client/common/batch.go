@@ -0,0 +1,229 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// agencyIDSize Size in bytes of the agency id that starts every batch
+const agencyIDSize = 4
+
+// batchSeqSize Size in bytes of the sequence number that follows the agency
+// id of a batch
+const batchSeqSize = 8
+
+// batchHeaderSize Size in bytes of the agency id and the sequence number
+const batchHeaderSize = agencyIDSize + batchSeqSize
+
+// envelopeOverhead Bytes added to a batch payload when it is framed: the
+// frame header and the message header
+const envelopeOverhead = protocol.HeaderSize + protocol.MessageHeaderSize
+
+// batchOverhead Bytes of the framed batch message that do not belong to
+// any bet
+const batchOverhead = envelopeOverhead + batchHeaderSize
+
+// DefaultBatchMaxBytes Default size budget of a whole framed batch message
+const DefaultBatchMaxBytes = 8 * 1024
+
+// DefaultCompressionThreshold Default size of the payload of a batch
+// above which it is compressed
+const DefaultCompressionThreshold = 512
+
+// BetTooLargeError Returned when a single bet does not fit in an empty batch
+type BetTooLargeError struct {
+	Size   int
+	Budget int
+}
+
+func (e *BetTooLargeError) Error() string {
+	return fmt.Sprintf("bet takes %d bytes but a batch can only hold %d bytes of bets", e.Size, e.Budget)
+}
+
+// Batch Group of bets of an agency sent to the server in a single message.
+// Its payload is the agency id (4 bytes) and the batch sequence number
+// (8 bytes) followed by every serialized bet wrapped in a Packet. The agency
+// id and the sequence number identify the batch, so the server can detect a
+// batch that is sent again because its acknowledgement was lost
+type Batch struct {
+	Agency  int
+	Seq     uint64
+	Bets    []Bet
+	payload []byte
+	// compressed Payload compressed with deflate, if the batch was built
+	// with compression
+	compressed []byte
+}
+
+// Payload Wire representation of the batch
+func (b Batch) Payload() []byte {
+	return b.payload
+}
+
+// Len Amount of bets in the batch
+func (b Batch) Len() int {
+	return len(b.Bets)
+}
+
+// DecodeBatch Rebuilds a batch from its wire representation
+func DecodeBatch(payload []byte) (Batch, error) {
+	if len(payload) < batchHeaderSize {
+		return Batch{}, fmt.Errorf("batch payload of %d bytes has no agency id and sequence number", len(payload))
+	}
+	batch := Batch{
+		Agency:  int(binary.BigEndian.Uint32(payload[:agencyIDSize])),
+		Seq:     binary.BigEndian.Uint64(payload[agencyIDSize:batchHeaderSize]),
+		payload: payload,
+	}
+
+	for offset := batchHeaderSize; offset < len(payload); {
+		if len(payload)-offset < protocol.HeaderSize {
+			return Batch{}, fmt.Errorf("truncated bet header at offset %d", offset)
+		}
+		length := int(binary.BigEndian.Uint32(payload[offset : offset+protocol.HeaderSize]))
+		offset += protocol.HeaderSize
+		if len(payload)-offset < length {
+			return Batch{}, fmt.Errorf("truncated bet at offset %d", offset)
+		}
+
+		var bet Bet
+		if err := bet.Deserialize(payload[offset : offset+length]); err != nil {
+			return Batch{}, err
+		}
+		batch.Bets = append(batch.Bets, bet)
+		offset += length
+	}
+	return batch, nil
+}
+
+// BatchBuilder Accumulates bets until the batch reaches either the maximum
+// amount of bets or the byte budget of the framed message. Every flushed
+// batch takes the next sequence number. With compression the payload is
+// compressed as bets are added, and a bet fits in the budget if either the
+// payload or its compressed form does
+type BatchBuilder struct {
+	agency     int
+	seq        uint64
+	maxAmount  int
+	maxBytes   int
+	bets       []Bet
+	payload    []byte
+	compressor *protocol.StreamCompressor
+}
+
+// NewBatchBuilder Initializes a builder for the agency received as parameter
+// whose first batch takes the sequence number seq. maxBytes is the budget
+// for the whole framed message, header included. A non positive maxAmount
+// leaves the byte budget as the only limit
+func NewBatchBuilder(agency int, seq uint64, maxAmount int, maxBytes int) *BatchBuilder {
+	builder := &BatchBuilder{
+		agency:    agency,
+		seq:       seq,
+		maxAmount: maxAmount,
+		maxBytes:  maxBytes,
+	}
+	builder.reset()
+	return builder
+}
+
+// Add Appends the bet to the batch being built. If the bet does not fit,
+// false is returned and the batch is left untouched so it can be flushed
+// before adding the bet again. A *BetTooLargeError is returned if the bet
+// would not fit even in an empty batch
+func (b *BatchBuilder) Add(bet Bet) (bool, error) {
+	data, err := bet.Serialize()
+	if err != nil {
+		return false, err
+	}
+
+	packet := protocol.NewPacket(data)
+	if batchOverhead+packet.Size() > b.maxBytes {
+		return false, &BetTooLargeError{Size: packet.Size(), Budget: b.maxBytes - batchOverhead}
+	}
+	if b.maxAmount > 0 && len(b.bets) >= b.maxAmount {
+		return false, nil
+	}
+
+	serialized := packet.Serialize()
+	fits := envelopeOverhead+len(b.payload)+len(serialized) <= b.maxBytes
+	if b.compressor != nil {
+		size, err := b.compressor.Append(serialized)
+		if err != nil {
+			return false, err
+		}
+		if !fits && envelopeOverhead+size > b.maxBytes {
+			b.compressor.Undo()
+			return false, nil
+		}
+	} else if !fits {
+		return false, nil
+	}
+
+	b.bets = append(b.bets, bet)
+	b.payload = append(b.payload, serialized...)
+	return true, nil
+}
+
+// SetCompression Enables or disables compressing the batches, starting with
+// the batch being built
+func (b *BatchBuilder) SetCompression(enabled bool) {
+	if !enabled {
+		b.compressor = nil
+		return
+	}
+	if b.compressor == nil {
+		b.compressor = protocol.NewStreamCompressor()
+		b.compressor.Append(b.payload)
+	}
+}
+
+// Empty Returns true if no bet has been added since the last flush
+func (b *BatchBuilder) Empty() bool {
+	return len(b.bets) == 0
+}
+
+// MaxAmount Maximum amount of bets of the batches being built
+func (b *BatchBuilder) MaxAmount() int {
+	return b.maxAmount
+}
+
+// SetMaxAmount Changes the maximum amount of bets, starting with the batch
+// being built
+func (b *BatchBuilder) SetMaxAmount(maxAmount int) {
+	b.maxAmount = maxAmount
+}
+
+// NextSeq Sequence number of the batch being built
+func (b *BatchBuilder) NextSeq() uint64 {
+	return b.seq
+}
+
+// Flush Returns the batch built so far and starts a new one with the next
+// sequence number
+func (b *BatchBuilder) Flush() Batch {
+	batch := Batch{
+		Agency:  b.agency,
+		Seq:     b.seq,
+		Bets:    b.bets,
+		payload: b.payload,
+	}
+	if b.compressor != nil {
+		batch.compressed = b.compressor.Bytes()
+	}
+	b.seq++
+	b.reset()
+	return batch
+}
+
+func (b *BatchBuilder) reset() {
+	b.bets = nil
+	b.payload = make([]byte, batchHeaderSize)
+	binary.BigEndian.PutUint32(b.payload[:agencyIDSize], uint32(b.agency))
+	binary.BigEndian.PutUint64(b.payload[agencyIDSize:], b.seq)
+	if b.compressor != nil {
+		b.compressor.Reset()
+		b.compressor.Append(b.payload)
+	}
+}
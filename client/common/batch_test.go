@@ -0,0 +1,129 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+func TestBatchBuilderHonorsMaxAmount(t *testing.T) {
+	builder := NewBatchBuilder(1, 1, 2, DefaultBatchMaxBytes)
+
+	for i := 0; i < 2; i++ {
+		if added, err := builder.Add(newTestBet()); !added || err != nil {
+			t.Fatalf("expected bet %d to be added, got %v, %v", i, added, err)
+		}
+	}
+	if added, err := builder.Add(newTestBet()); added || err != nil {
+		t.Fatalf("expected the batch to be full, got %v, %v", added, err)
+	}
+
+	batch := builder.Flush()
+	if batch.Len() != 2 || !builder.Empty() {
+		t.Fatalf("expected a batch of 2 bets and an empty builder, got %d", batch.Len())
+	}
+}
+
+func TestBatchBuilderHonorsByteBudget(t *testing.T) {
+	data, _ := newTestBet().Serialize()
+	betSize := 4 + len(data)
+	budget := batchOverhead + 3*betSize + betSize/2
+	builder := NewBatchBuilder(1, 1, 100, budget)
+
+	for {
+		added, err := builder.Add(newTestBet())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !added {
+			break
+		}
+	}
+
+	batch := builder.Flush()
+	if batch.Len() != 3 {
+		t.Fatalf("expected 3 bets to fit in the budget, got %d", batch.Len())
+	}
+	if framed := envelopeOverhead + len(batch.Payload()); framed > budget {
+		t.Fatalf("framed batch takes %d bytes, budget is %d", framed, budget)
+	}
+}
+
+func TestBatchBuilderRejectsBetLargerThanBudget(t *testing.T) {
+	builder := NewBatchBuilder(1, 1, 100, DefaultBatchMaxBytes)
+	bet := newTestBet()
+	bet.LastName = strings.Repeat("a", DefaultBatchMaxBytes)
+
+	_, err := builder.Add(bet)
+	var tooLarge *BetTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected *BetTooLargeError, got %v", err)
+	}
+	if !builder.Empty() {
+		t.Fatal("expected the rejected bet not to be added")
+	}
+}
+
+func TestBatchBuilderNumbersFlushedBatches(t *testing.T) {
+	builder := NewBatchBuilder(3, 7, 1, DefaultBatchMaxBytes)
+
+	for _, expected := range []uint64{7, 8} {
+		if _, err := builder.Add(newTestBet()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		batch := builder.Flush()
+		if batch.Seq != expected {
+			t.Fatalf("expected sequence number %d, got %d", expected, batch.Seq)
+		}
+
+		decoded, err := DecodeBatch(batch.Payload())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if decoded.Agency != 3 || decoded.Seq != expected || decoded.Len() != 1 {
+			t.Fatalf("unexpected decoded batch %+v", decoded)
+		}
+	}
+	if builder.NextSeq() != 9 {
+		t.Fatalf("expected next sequence number 9, got %d", builder.NextSeq())
+	}
+}
+
+func TestCompressedBatchesHoldMoreBets(t *testing.T) {
+	data, _ := newTestBet().Serialize()
+	budget := batchOverhead + 3*(4+len(data))
+	raw := NewBatchBuilder(1, 1, 100, budget)
+	compressed := NewBatchBuilder(1, 1, 100, budget)
+	compressed.SetCompression(true)
+
+	for _, builder := range []*BatchBuilder{raw, compressed} {
+		for {
+			added, err := builder.Add(newTestBet())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !added {
+				break
+			}
+		}
+	}
+
+	rawBatch, batch := raw.Flush(), compressed.Flush()
+	if batch.Len() <= rawBatch.Len() {
+		t.Fatalf("expected more than %d bets in the compressed batch, got %d", rawBatch.Len(), batch.Len())
+	}
+	if framed := envelopeOverhead + len(batch.compressed); framed > budget {
+		t.Fatalf("framed compressed batch takes %d bytes, budget is %d", framed, budget)
+	}
+	inflated, err := protocol.Inflate(batch.compressed, len(batch.Payload()))
+	if err != nil {
+		t.Fatalf("could not inflate the batch: %v", err)
+	}
+	if !bytes.Equal(inflated, batch.Payload()) {
+		t.Fatal("the compressed batch does not inflate to its payload")
+	}
+}
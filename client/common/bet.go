@@ -0,0 +1,156 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Tags used to identify every field of a serialized Bet
+const (
+	BetFieldAgency byte = iota + 1
+	BetFieldFirstName
+	BetFieldLastName
+	BetFieldDocument
+	BetFieldBirthdate
+	BetFieldNumber
+)
+
+// tlvHeaderSize Size of the tag (1 byte) plus the length (2 bytes) of a field
+const tlvHeaderSize = 3
+
+// MaxBetFieldLength Maximum length in bytes of a serialized field value
+const MaxBetFieldLength = math.MaxUint16
+
+// Bet A lottery bet registry. It mirrors the Bet class of the server
+type Bet struct {
+	Agency    int
+	FirstName string
+	LastName  string
+	Document  string
+	Birthdate string
+	Number    int
+}
+
+// Record Returns the bet as a row of an agency file: first_name, last_name,
+// document, birthdate and number
+func (b Bet) Record() []string {
+	return []string{b.FirstName, b.LastName, b.Document, b.Birthdate, strconv.Itoa(b.Number)}
+}
+
+// Serialize Encodes the bet using a type-length-value format: every field is
+// written as a 1 byte tag, a 2 bytes big-endian length and the value. Numeric
+// fields are written as their decimal representation
+func (b Bet) Serialize() ([]byte, error) {
+	fields := []struct {
+		tag   byte
+		value string
+	}{
+		{BetFieldAgency, strconv.Itoa(b.Agency)},
+		{BetFieldFirstName, b.FirstName},
+		{BetFieldLastName, b.LastName},
+		{BetFieldDocument, b.Document},
+		{BetFieldBirthdate, b.Birthdate},
+		{BetFieldNumber, strconv.Itoa(b.Number)},
+	}
+
+	size := 0
+	for _, field := range fields {
+		if len(field.value) > MaxBetFieldLength {
+			return nil, fmt.Errorf("bet field %s is %d bytes long, maximum is %d",
+				betFieldName(field.tag), len(field.value), MaxBetFieldLength)
+		}
+		size += tlvHeaderSize + len(field.value)
+	}
+
+	buf := make([]byte, size)
+	offset := 0
+	for _, field := range fields {
+		buf[offset] = field.tag
+		binary.BigEndian.PutUint16(buf[offset+1:offset+tlvHeaderSize], uint16(len(field.value)))
+		offset += tlvHeaderSize
+		offset += copy(buf[offset:], field.value)
+	}
+	return buf, nil
+}
+
+// Deserialize Decodes a bet previously encoded with Serialize. Every field
+// must be present exactly once
+func (b *Bet) Deserialize(data []byte) error {
+	var decoded Bet
+	seen := make(map[byte]bool)
+
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < tlvHeaderSize {
+			return fmt.Errorf("truncated bet field header at offset %d", offset)
+		}
+		tag := data[offset]
+		length := int(binary.BigEndian.Uint16(data[offset+1 : offset+tlvHeaderSize]))
+		offset += tlvHeaderSize
+		if len(data)-offset < length {
+			return fmt.Errorf("truncated bet field %s: expected %d bytes, %d available",
+				betFieldName(tag), length, len(data)-offset)
+		}
+		value := string(data[offset : offset+length])
+		offset += length
+
+		if seen[tag] {
+			return fmt.Errorf("duplicated bet field %s", betFieldName(tag))
+		}
+		seen[tag] = true
+
+		var err error
+		switch tag {
+		case BetFieldAgency:
+			decoded.Agency, err = strconv.Atoi(value)
+		case BetFieldFirstName:
+			decoded.FirstName = value
+		case BetFieldLastName:
+			decoded.LastName = value
+		case BetFieldDocument:
+			decoded.Document = value
+		case BetFieldBirthdate:
+			decoded.Birthdate = value
+		case BetFieldNumber:
+			decoded.Number, err = strconv.Atoi(value)
+		default:
+			return fmt.Errorf("unknown bet field tag %d", tag)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "invalid bet field %s", betFieldName(tag))
+		}
+	}
+
+	for tag := BetFieldAgency; tag <= BetFieldNumber; tag++ {
+		if !seen[tag] {
+			return fmt.Errorf("missing bet field %s", betFieldName(tag))
+		}
+	}
+
+	*b = decoded
+	return nil
+}
+
+// betFieldName Returns the name of the field identified by the tag, with
+// the same naming used by the server
+func betFieldName(tag byte) string {
+	switch tag {
+	case BetFieldAgency:
+		return "agency"
+	case BetFieldFirstName:
+		return "first_name"
+	case BetFieldLastName:
+		return "last_name"
+	case BetFieldDocument:
+		return "document"
+	case BetFieldBirthdate:
+		return "birthdate"
+	case BetFieldNumber:
+		return "number"
+	default:
+		return fmt.Sprintf("unknown(%d)", tag)
+	}
+}
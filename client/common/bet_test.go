@@ -0,0 +1,139 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func newTestBet() Bet {
+	return Bet{
+		Agency:    1,
+		FirstName: "Santiago Lionel",
+		LastName:  "Lorca",
+		Document:  "30904465",
+		Birthdate: "1999-03-17",
+		Number:    2201,
+	}
+}
+
+func TestBetSerializeDeserializeKeepsFields(t *testing.T) {
+	bet := newTestBet()
+
+	data, err := bet.Serialize()
+	if err != nil {
+		t.Fatalf("unexpected serialize error: %v", err)
+	}
+
+	var decoded Bet
+	if err := decoded.Deserialize(data); err != nil {
+		t.Fatalf("unexpected deserialize error: %v", err)
+	}
+	if decoded != bet {
+		t.Fatalf("expected %+v, got %+v", bet, decoded)
+	}
+}
+
+func TestBetSerializeKeepsNonASCIINames(t *testing.T) {
+	bet := newTestBet()
+	bet.FirstName = "Tiago Nicolás"
+	bet.LastName = "Muñoz"
+
+	data, err := bet.Serialize()
+	if err != nil {
+		t.Fatalf("unexpected serialize error: %v", err)
+	}
+
+	var decoded Bet
+	if err := decoded.Deserialize(data); err != nil {
+		t.Fatalf("unexpected deserialize error: %v", err)
+	}
+	if decoded != bet {
+		t.Fatalf("expected %+v, got %+v", bet, decoded)
+	}
+}
+
+func TestBetSerializeRejectsTooLongField(t *testing.T) {
+	bet := newTestBet()
+	bet.FirstName = strings.Repeat("a", MaxBetFieldLength+1)
+
+	if _, err := bet.Serialize(); err == nil {
+		t.Fatal("expected an error for a field longer than the TLV limit")
+	}
+}
+
+func TestBetDeserializeRejectsTruncatedData(t *testing.T) {
+	data, _ := newTestBet().Serialize()
+
+	var decoded Bet
+	if err := decoded.Deserialize(data[:len(data)-1]); err == nil {
+		t.Fatal("expected an error for truncated data")
+	}
+}
+
+func TestBetDeserializeRejectsMissingField(t *testing.T) {
+	data, _ := newTestBet().Serialize()
+	// The agency field is the first one: tag, 2 bytes of length and "1"
+	withoutAgency := data[tlvHeaderSize+1:]
+
+	var decoded Bet
+	if err := decoded.Deserialize(withoutAgency); err == nil {
+		t.Fatal("expected an error for a missing field")
+	}
+}
+
+func TestBetDeserializeRejectsUnknownTag(t *testing.T) {
+	data, _ := newTestBet().Serialize()
+	data = append(data, 0xFF, 0x00, 0x00)
+
+	var decoded Bet
+	if err := decoded.Deserialize(data); err == nil {
+		t.Fatal("expected an error for an unknown tag")
+	}
+}
+
+func TestBetValidateAcceptsValidBet(t *testing.T) {
+	if err := newTestBet().Validate(); err != nil {
+		t.Fatalf("expected a valid bet, got %v", err)
+	}
+}
+
+func TestBetValidateReportsEveryInvalidField(t *testing.T) {
+	bet := Bet{
+		Agency:    1,
+		FirstName: " ",
+		LastName:  "Lorca",
+		Document:  "30A04465",
+		Birthdate: "17/03/1999",
+		Number:    10000,
+	}
+
+	err := bet.Validate()
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected *ValidationError, got %v", err)
+	}
+
+	fields := make(map[string]bool)
+	for _, fieldErr := range validationErr.Errors {
+		fields[fieldErr.Field] = true
+	}
+	for _, expected := range []string{"first_name", "document", "birthdate", "number"} {
+		if !fields[expected] {
+			t.Errorf("expected a violation for %s, got %v", expected, validationErr)
+		}
+	}
+	if len(validationErr.Errors) != 4 {
+		t.Errorf("expected 4 violations, got %d: %v", len(validationErr.Errors), validationErr)
+	}
+}
+
+func TestBetValidateRejectsFutureBirthdateAndOutOfRangeDocument(t *testing.T) {
+	bet := newTestBet()
+	bet.Birthdate = "2999-01-01"
+	bet.Document = "123456789"
+
+	validationErr, ok := bet.Validate().(*ValidationError)
+	if !ok || len(validationErr.Errors) != 2 {
+		t.Fatalf("expected 2 violations, got %v", validationErr)
+	}
+}
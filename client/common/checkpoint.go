@@ -0,0 +1,200 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Checkpoint Progress made over an agency file: every row before Position
+// has been handled and the batch that starts there takes the sequence
+// number NextSeq. BatchAmount is the amount of bets of that batch when
+// batches are sized adaptively, so a resumed client builds it with the same
+// rows. Size and PrefixHash identify the file, so a checkpoint is not
+// applied to a file that changed since it was taken
+type Checkpoint struct {
+	BetsFile    string         `json:"bets_file"`
+	Position    ReaderPosition `json:"position"`
+	NextSeq     uint64         `json:"next_batch_seq"`
+	BatchAmount int            `json:"batch_amount,omitempty"`
+	Size        int64          `json:"size"`
+	PrefixHash  string         `json:"prefix_sha256"`
+}
+
+// CheckpointMismatchError Returned when the agency file does not match the
+// one the checkpoint was taken from
+type CheckpointMismatchError struct {
+	Reason string
+}
+
+func (e *CheckpointMismatchError) Error() string {
+	return "bets file changed since the last checkpoint: " + e.Reason +
+		" (use --restart-from-scratch to send the whole file again)"
+}
+
+// Checkpointer Persists the progress made over an agency file, so a client
+// that is restarted does not send again the bets already acknowledged
+type Checkpointer struct {
+	path     string
+	betsFile *os.File
+	hash     hash.Hash
+	hashed   int64
+}
+
+// OpenCheckpointer Loads the checkpoint stored at path for the agency file
+// received as parameter, checking that the file did not change since the
+// checkpoint was taken, and returns it. If there is no checkpoint the file
+// is read from the start with the first sequence number. If restart is true
+// the previous position is discarded, but sequence numbers keep growing so
+// the server does not take the bets sent again as duplicates
+func OpenCheckpointer(path string, betsFilePath string, restart bool) (*Checkpointer, Checkpoint, error) {
+	start := Checkpoint{NextSeq: 1}
+	betsFile, err := os.Open(betsFilePath)
+	if err != nil {
+		return nil, start, errors.Wrapf(err, "could not open bets file %s", betsFilePath)
+	}
+	c := &Checkpointer{path: path, betsFile: betsFile, hash: sha256.New()}
+
+	checkpoint, err := c.load()
+	if restart {
+		if err == nil && checkpoint != nil && checkpoint.NextSeq > start.NextSeq {
+			start.NextSeq = checkpoint.NextSeq
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			c.Close()
+			return nil, start, errors.Wrapf(err, "could not remove checkpoint %s", path)
+		}
+		return c, start, nil
+	}
+
+	if err != nil {
+		c.Close()
+		return nil, start, err
+	}
+	if checkpoint == nil {
+		return c, start, nil
+	}
+	if err := c.verify(*checkpoint); err != nil {
+		c.Close()
+		return nil, start, err
+	}
+	if checkpoint.NextSeq < start.NextSeq {
+		checkpoint.NextSeq = start.NextSeq
+	}
+	return c, *checkpoint, nil
+}
+
+// Save Records that every row before the position has been handled and
+// that nextSeq is the sequence number of the batch that starts there, made
+// of up to batchAmount bets. The checkpoint is written to a temporary file
+// that then replaces the previous one, so a crash never leaves a partially
+// written checkpoint
+func (c *Checkpointer) Save(position ReaderPosition, nextSeq uint64, batchAmount int) error {
+	if err := c.hashUpTo(position.Offset); err != nil {
+		return err
+	}
+	info, err := c.betsFile.Stat()
+	if err != nil {
+		return errors.Wrap(err, "could not stat bets file")
+	}
+
+	data, err := json.Marshal(Checkpoint{
+		BetsFile:    c.betsFile.Name(),
+		Position:    position,
+		NextSeq:     nextSeq,
+		BatchAmount: batchAmount,
+		Size:        info.Size(),
+		PrefixHash:  hex.EncodeToString(c.hash.Sum(nil)),
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not encode checkpoint")
+	}
+
+	tmp := c.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "could not create checkpoint %s", tmp)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "could not write checkpoint %s", tmp)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "could not sync checkpoint %s", tmp)
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrapf(err, "could not close checkpoint %s", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, c.path), "could not replace checkpoint %s", c.path)
+}
+
+// Close Closes the agency file opened to hash its content
+func (c *Checkpointer) Close() error {
+	return c.betsFile.Close()
+}
+
+// load Reads the stored checkpoint. nil is returned if there is none
+func (c *Checkpointer) load() (*Checkpoint, error) {
+	data, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read checkpoint %s", c.path)
+	}
+
+	var checkpoint Checkpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, errors.Wrapf(err, "could not decode checkpoint %s", c.path)
+	}
+	return &checkpoint, nil
+}
+
+// verify Checks that the checkpoint was taken from the configured agency
+// file and that the file has the size and the prefix recorded in it
+func (c *Checkpointer) verify(checkpoint Checkpoint) error {
+	if filepath.Clean(checkpoint.BetsFile) != filepath.Clean(c.betsFile.Name()) {
+		return &CheckpointMismatchError{
+			Reason: fmt.Sprintf("checkpoint was taken from %s, not from %s", checkpoint.BetsFile, c.betsFile.Name()),
+		}
+	}
+	info, err := c.betsFile.Stat()
+	if err != nil {
+		return errors.Wrap(err, "could not stat bets file")
+	}
+	if info.Size() != checkpoint.Size {
+		return &CheckpointMismatchError{
+			Reason: fmt.Sprintf("size changed from %d to %d bytes", checkpoint.Size, info.Size()),
+		}
+	}
+
+	if err := c.hashUpTo(checkpoint.Position.Offset); err != nil {
+		return err
+	}
+	if hex.EncodeToString(c.hash.Sum(nil)) != checkpoint.PrefixHash {
+		return &CheckpointMismatchError{Reason: "content of the rows already sent changed"}
+	}
+	return nil
+}
+
+// hashUpTo Extends the hash of the file prefix up to the offset. The hash
+// is computed incrementally, since offsets only grow
+func (c *Checkpointer) hashUpTo(offset int64) error {
+	if offset < c.hashed {
+		return errors.Errorf("checkpoint offset %d is behind the last one %d", offset, c.hashed)
+	}
+	n, err := io.CopyN(c.hash, c.betsFile, offset-c.hashed)
+	c.hashed += n
+	if err == io.EOF {
+		return &CheckpointMismatchError{Reason: "file is shorter than the checkpoint offset"}
+	}
+	return errors.Wrap(err, "could not hash bets file")
+}
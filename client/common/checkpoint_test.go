@@ -0,0 +1,134 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+const checkpointTestRow = "Santiago Lionel,Lorca,30904465,1999-03-17,2201\n"
+
+// saveTestCheckpoint Stores a checkpoint of the agency file after its first
+// row, with the batch that starts there numbered 5
+func saveTestCheckpoint(t *testing.T, betsFile string) (string, ReaderPosition) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	checkpointer, _, err := OpenCheckpointer(path, betsFile, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer checkpointer.Close()
+
+	position := ReaderPosition{Offset: int64(len(checkpointTestRow)), Line: 2}
+	if err := checkpointer.Save(position, 5, 3); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return path, position
+}
+
+func TestCheckpointerStartsFromScratchWithoutCheckpoint(t *testing.T) {
+	betsFile := writeAgencyFile(t, checkpointTestRow)
+	checkpointer, checkpoint, err := OpenCheckpointer(filepath.Join(t.TempDir(), "checkpoint.json"), betsFile, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer checkpointer.Close()
+	if checkpoint.Position != (ReaderPosition{}) || checkpoint.NextSeq != 1 {
+		t.Fatalf("expected to start at the first row with batch 1, got %+v", checkpoint)
+	}
+}
+
+func TestCheckpointerResumesFromSavedPosition(t *testing.T) {
+	betsFile := writeAgencyFile(t, checkpointTestRow+checkpointTestRow)
+	path, position := saveTestCheckpoint(t, betsFile)
+
+	checkpointer, checkpoint, err := OpenCheckpointer(path, betsFile, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer checkpointer.Close()
+	if checkpoint.Position != position || checkpoint.NextSeq != 5 || checkpoint.BatchAmount != 3 {
+		t.Fatalf("expected to resume at %+v with batch 5 of 3 bets, got %+v", position, checkpoint)
+	}
+}
+
+func TestCheckpointerDetectsChangedFile(t *testing.T) {
+	changes := map[string]string{
+		"size":   checkpointTestRow + checkpointTestRow + checkpointTestRow,
+		"prefix": "Santiago Lionel,Lorca,30904466,1999-03-17,2201\n" + checkpointTestRow,
+	}
+	for name, content := range changes {
+		t.Run(name, func(t *testing.T) {
+			betsFile := writeAgencyFile(t, checkpointTestRow+checkpointTestRow)
+			path, _ := saveTestCheckpoint(t, betsFile)
+			if err := os.WriteFile(betsFile, []byte(content), 0644); err != nil {
+				t.Fatalf("could not change agency file: %v", err)
+			}
+
+			_, _, err := OpenCheckpointer(path, betsFile, false)
+			var mismatch *CheckpointMismatchError
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("expected *CheckpointMismatchError, got %v", err)
+			}
+
+			checkpointer, checkpoint, err := OpenCheckpointer(path, betsFile, true)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer checkpointer.Close()
+			if checkpoint.Position != (ReaderPosition{}) || checkpoint.NextSeq != 5 {
+				t.Fatalf("expected to restart at the first row keeping batch 5, got %+v", checkpoint)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Fatalf("expected the checkpoint to be removed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckpointerRejectsCheckpointOfAnotherFile(t *testing.T) {
+	betsFile := writeAgencyFile(t, checkpointTestRow+checkpointTestRow)
+	path, _ := saveTestCheckpoint(t, betsFile)
+	otherFile := writeAgencyFile(t, checkpointTestRow+checkpointTestRow)
+
+	_, _, err := OpenCheckpointer(path, otherFile, false)
+	var mismatch *CheckpointMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("expected *CheckpointMismatchError, got %v", err)
+	}
+}
+
+func TestCheckpointerRejectsCorruptCheckpoint(t *testing.T) {
+	betsFile := writeAgencyFile(t, checkpointTestRow+checkpointTestRow)
+	path, _ := saveTestCheckpoint(t, betsFile)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	corruptions := map[string][]byte{
+		"truncated": data[:len(data)/2],
+		"garbage":   []byte("\x00\x01not a checkpoint"),
+	}
+	for name, content := range corruptions {
+		t.Run(name, func(t *testing.T) {
+			if err := os.WriteFile(path, content, 0644); err != nil {
+				t.Fatalf("could not corrupt checkpoint: %v", err)
+			}
+			if _, _, err := OpenCheckpointer(path, betsFile, false); err == nil {
+				t.Fatal("expected a corrupt checkpoint to be rejected")
+			}
+
+			checkpointer, checkpoint, err := OpenCheckpointer(path, betsFile, true)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer checkpointer.Close()
+			if checkpoint.Position != (ReaderPosition{}) || checkpoint.NextSeq != 1 {
+				t.Fatalf("expected to restart from scratch, got %+v", checkpoint)
+			}
+		})
+	}
+}
@@ -1,89 +1,1253 @@
 package common
 
 import (
-	"bufio"
-	"fmt"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
 	"net"
+	"strconv"
 	"time"
 
-	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/auth"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/logger"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
 )
 
-var log = logging.MustGetLogger("log")
+var log = logger.Get()
+
+// RetryPolicy Configuration of the retries made while the server cannot
+// be reached. A non positive MaxAttempts retries until the client is stopped
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Jitter         float64
+}
 
 // ClientConfig Configuration used by the client
 type ClientConfig struct {
-	ID            string
-	ServerAddress string
-	LoopAmount    int
-	LoopPeriod    time.Duration
+	ID             string
+	ServerAddress  string
+	ConnectTimeout time.Duration
+	ReadTimeout    time.Duration
+	WriteTimeout   time.Duration
+	Retry          RetryPolicy
+	ConnectionMode ConnectionMode
+	LoopPeriod     time.Duration
+	MaxFrameSize   int
+
+	// TLS Configuration of the TLS sessions with the server. A nil value
+	// keeps the connections in plain TCP
+	TLS *tls.Config
+	// Secret Shared with the central to sign every message sent. A nil
+	// value sends messages unsigned
+	Secret []byte
+	// BuildVersion Version of the client binary, sent to the server in the
+	// hello of every connection
+	BuildVersion string
+
+	BetsFile         string
+	InvalidBetPolicy InvalidBetPolicy
+	QuarantineFile   string
+
+	// CheckpointFile File where the progress over the bets file is stored.
+	// An empty value disables checkpoints
+	CheckpointFile     string
+	RestartFromScratch bool
+	// SeqFile File where the sequence number of the next batch built by
+	// Send is stored. An empty value numbers them from SendSeqBase on every
+	// new client
+	SeqFile string
+
+	BatchMaxAmount int
+	BatchMaxBytes  int
+	// BatchWindow Batches of the agency file that can be in flight at the
+	// same time. Values above 1 pipeline them on a persistent connection
+	BatchWindow int
+	// BatchAdaptive Adapts the amount of bets of the batches of the agency
+	// file to the latency of their acknowledgements, starting from
+	// BatchMaxAmount. Only supported without pipelining
+	BatchAdaptive      bool
+	BatchTargetLatency time.Duration
+
+	// CompressionEnabled Asks the server to accept compressed batches when
+	// every connection starts. Only batches whose payload is larger than
+	// CompressionThreshold bytes are compressed
+	CompressionEnabled   bool
+	CompressionThreshold int
+
+	// OutboxDir Directory of the outbox. An empty value disables it
+	OutboxDir         string
+	OutboxFsync       FsyncPolicy
+	OutboxSegmentSize int64
+
+	WinnersTimeout        time.Duration
+	WinnersInitialBackoff time.Duration
+	WinnersMaxBackoff     time.Duration
 }
 
-// Client Entity that encapsulates how
+// Client Entity that encapsulates how an agency talks to the central. Every
+// operation receives a context that can cancel it mid-flight. A Client is
+// not safe for concurrent use
 type Client struct {
-	config ClientConfig
-	conn   net.Conn
+	config           ClientConfig
+	conn             *connection
+	codec            *protocol.Codec
+	finishedNotified bool
+	report           RunReport
+	outbox           *Outbox
+	checkpointer     *Checkpointer
+	// rejected File where the bets rejected by the server are written
+	rejected *rowsFile
+	// pipeline Sends the batches of the agency file when pipelining is enabled
+	pipeline *pipeline
+	// sizer Adapts the size of the batches of the agency file when adaptive
+	// sizing is enabled
+	sizer *BatchSizer
+	// version and features Version of the protocol and optional features
+	// the server selected on the last connection
+	version  protocol.Version
+	features protocol.Feature
+	greeted  bool
+	// signer Signs the messages sent when a secret is configured
+	signer *auth.Signer
+	// nextSeq Sequence number of the next batch built by Send
+	nextSeq uint64
+	// sequences Persists nextSeq when a sequence file is configured
+	sequences *SeqStore
 }
 
 // NewClient Initializes a new client receiving the configuration
-// as a parameter
-func NewClient(config ClientConfig) *Client {
+// as a parameter. An error is returned if the configuration combines
+// options that cannot be used together
+func NewClient(config ClientConfig) (*Client, error) {
+	if config.BatchWindow > 1 && config.ConnectionMode != ConnectionPersistent {
+		return nil, categorize(ErrConfig, errors.Errorf("a batch window of %d requires a persistent connection", config.BatchWindow))
+	}
+	// Batches in flight must be rebuilt with the same bets after a restart,
+	// which the checkpoint only guarantees for one adaptive batch at a time
+	if config.BatchAdaptive && config.BatchWindow > 1 {
+		return nil, categorize(ErrConfig, errors.Errorf("adaptive batch sizing cannot be used with a batch window of %d", config.BatchWindow))
+	}
+
 	client := &Client{
-		config: config,
+		config:  config,
+		codec:   protocol.NewCodec(config.MaxFrameSize),
+		nextSeq: SendSeqBase,
+	}
+	if config.SeqFile != "" {
+		client.sequences = NewSeqStore(config.SeqFile)
+	}
+	return client, nil
+}
+
+// createClientSocket Initializes client socket, retrying with exponential
+// backoff while the server cannot be reached or does not answer the hello.
+// In case every attempt fails the error is logged and returned
+func (c *Client) createClientSocket(ctx context.Context) error {
+	retry := c.config.Retry
+	backoff := NewBackoff(retry.InitialBackoff, retry.MaxBackoff, retry.Jitter)
+	dialer := net.Dialer{Timeout: c.config.ConnectTimeout}
+
+	for attempt := 1; ; attempt++ {
+		conn, err := dialer.DialContext(ctx, "tcp", c.config.ServerAddress)
+		if err == nil && c.config.TLS != nil {
+			conn, err = c.startTLS(ctx, conn)
+		}
+		if err == nil {
+			c.conn = newConnection(conn)
+			if err = c.greet(ctx); err == nil {
+				return nil
+			}
+			c.closeConnection()
+			// Only a hello that did not get an answer is sent again
+			if !isNetworkFailure(err) {
+				return err
+			}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var handshakeErr *HandshakeError
+		if errors.As(err, &handshakeErr) {
+			log.Critical("tls_handshake", "fail", logger.F("client_id", c.config.ID), logger.F("error", err))
+			return err
+		}
+		err = classifyNetError("connect", err)
+		if retry.MaxAttempts > 0 && attempt >= retry.MaxAttempts {
+			log.Critical("connect", "fail",
+				logger.F("client_id", c.config.ID),
+				logger.F("attempts", attempt),
+				logger.F("reason", failureReason(err)),
+				logger.F("error", err),
+			)
+			return categorize(
+				ErrServerUnavailable,
+				errors.Wrapf(err, "could not connect to %s after %d attempts", c.config.ServerAddress, attempt),
+			)
+		}
+
+		delay := backoff.Next()
+		log.Warning("connect", "retry",
+			logger.F("client_id", c.config.ID),
+			logger.F("attempt", attempt),
+			logger.F("retry_in", delay),
+			logger.F("reason", failureReason(err)),
+			logger.F("error", err),
+		)
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+		c.report.Retries++
 	}
-	return client
 }
 
-// CreateClientSocket Initializes client socket. In case of
-// failure, error is printed in stdout/stderr and exit 1
-// is returned
-func (c *Client) createClientSocket() error {
-	conn, err := net.Dial("tcp", c.config.ServerAddress)
+// greet Sends the hello that starts every connection, with the versions
+// of the protocol the client speaks, the agency, the build of the client
+// and the optional features it asks for. Like every message it is signed
+// when a secret is configured, so the server can authenticate the agency
+// before any data. The server answers with the version and features to use.
+// A server that predates the hello answers with an error, and the connection
+// goes on with the first version and without optional features, unless a
+// secret is configured, since such a server does not accept signed messages
+func (c *Client) greet(ctx context.Context) error {
+	agency, err := c.agency()
+	if err != nil {
+		return err
+	}
+	hello := protocol.Hello{
+		MinVersion: protocol.MinVersion,
+		MaxVersion: protocol.MaxVersion,
+		Agency:     uint32(agency),
+		Features:   c.requestedFeatures(),
+		Build:      c.config.BuildVersion,
+	}
+	c.version = protocol.Version1
+	c.features = 0
+	c.greeted = true
+
+	request := protocol.NewMessage(protocol.MsgHello, hello.Serialize())
+	response, err := c.exchange(ctx, request)
 	if err != nil {
-		log.Criticalf(
-			"action: connect | result: fail | client_id: %v | error: %v",
-			c.config.ID,
-			err,
+		return err
+	}
+	switch response.Kind {
+	case protocol.MsgError:
+		if !isUnknownKind(response.Payload) {
+			err := &ServerError{Request: request.Kind, Reason: string(response.Payload)}
+			log.Critical("hello", "fail", logger.F("client_id", c.config.ID), logger.F("error", err))
+			return err
+		}
+		if c.config.Secret != nil {
+			// The server predates the hello and signed messages, so it
+			// could not authenticate any message of the agency
+			err := categorize(ErrConfig, errors.New("the server does not accept signed messages, the secret cannot be used with it"))
+			log.Critical("hello", "fail", logger.F("client_id", c.config.ID), logger.F("error", err))
+			return err
+		}
+		// The server predates the hello
+		log.Warning("hello", "fail",
+			logger.F("client_id", c.config.ID),
+			logger.F("version", c.version),
+			logger.F("error", response.Payload),
 		)
+		return nil
+	case protocol.MsgHello:
+	default:
+		return &UnexpectedResponseError{Request: request.Kind, Expected: protocol.MsgHello, Got: response.Kind}
+	}
+
+	reply, err := protocol.DeserializeHelloReply(response.Payload)
+	if err != nil {
+		return categorize(ErrProtocol, err)
+	}
+	if reply.Version < hello.MinVersion || reply.Version > hello.MaxVersion {
+		return &UnsupportedVersionError{Version: reply.Version, Min: hello.MinVersion, Max: hello.MaxVersion}
 	}
-	c.conn = conn
+	c.version = reply.Version
+	c.features = reply.Features & hello.Features
+	log.Info("hello", "success",
+		logger.F("client_id", c.config.ID),
+		logger.F("version", c.version),
+		logger.F("build", c.config.BuildVersion),
+		logger.F("compression", c.compressing()),
+		logger.F("pipelining", c.features.Has(protocol.FeaturePipelining)),
+	)
 	return nil
 }
 
-// StartClientLoop Send messages to the client until some time threshold is met
-func (c *Client) StartClientLoop() {
-	// There is an autoincremental msgID to identify every message sent
-	// Messages if the message amount threshold has not been surpassed
-	for msgID := 1; msgID <= c.config.LoopAmount; msgID++ {
-		// Create the connection the server in every loop iteration. Send an
-		c.createClientSocket()
-
-		// TODO: Modify the send to avoid short-write
-		fmt.Fprintf(
-			c.conn,
-			"[CLIENT %v] Message N°%v\n",
-			c.config.ID,
-			msgID,
+// requestedFeatures Optional features enabled in the configuration
+func (c *Client) requestedFeatures() protocol.Feature {
+	var features protocol.Feature
+	if c.config.CompressionEnabled {
+		features |= protocol.FeatureCompression
+	}
+	if c.config.BatchWindow > 1 {
+		features |= protocol.FeaturePipelining
+	}
+	return features
+}
+
+// compressing Returns true if the server accepted compressed batches on the
+// last connection
+func (c *Client) compressing() bool {
+	return c.features.Has(protocol.FeatureCompression)
+}
+
+// newBatchBuilder Initializes a builder of batches of the agency that
+// compresses them if the server accepts it. The connection is opened in
+// advance if no hello was exchanged yet, since the batches depend on what
+// the server accepts
+func (c *Client) newBatchBuilder(ctx context.Context, agency int, seq uint64, maxAmount int) (*BatchBuilder, error) {
+	builder := NewBatchBuilder(agency, seq, maxAmount, c.batchBudget())
+	if !c.greeted {
+		if err := c.createClientSocket(ctx); err != nil {
+			return nil, err
+		}
+	}
+	builder.SetCompression(c.compressing())
+	return builder, nil
+}
+
+// batchBudget Size budget of a framed batch message
+func (c *Client) batchBudget() int {
+	if c.config.Secret != nil {
+		// The signed message wrapping the batch has to fit in the budget
+		return c.config.BatchMaxBytes - auth.Overhead
+	}
+	return c.config.BatchMaxBytes
+}
+
+// compressedPayload Returns the payload of the batch compressed if the
+// server accepts compression, it is larger than the threshold and
+// compressing it saves space. Otherwise nil is returned
+func (c *Client) compressedPayload(batch Batch) []byte {
+	payload := batch.Payload()
+	if !c.compressing() || len(payload) <= c.config.CompressionThreshold {
+		return nil
+	}
+
+	compressed := batch.compressed
+	if compressed == nil {
+		var err error
+		if compressed, err = protocol.Deflate(payload); err != nil {
+			return nil
+		}
+	}
+	if len(compressed) >= len(payload) {
+		return nil
+	}
+	return compressed
+}
+
+// needsSplit Returns true if the batch is sent uncompressed but does not
+// fit in the budget that way. This happens to batches built by Send for a
+// connection that accepted compression when the current one does not.
+// Batches of the bets file are sized uncompressed, so they never need it
+func (c *Client) needsSplit(batch Batch) bool {
+	return envelopeOverhead+len(batch.Payload()) > c.batchBudget() && c.compressedPayload(batch) == nil
+}
+
+// batchMessage Returns the message that carries the batch, with its payload
+// compressed when compressedPayload allows it
+func (c *Client) batchMessage(batch Batch) protocol.Message {
+	payload := batch.Payload()
+	compressed := c.compressedPayload(batch)
+	if compressed == nil {
+		return protocol.NewMessage(protocol.MsgBatchBet, payload)
+	}
+
+	c.report.BytesBeforeCompression += int64(len(payload))
+	c.report.BytesAfterCompression += int64(len(compressed))
+	log.Debug("compress_batch", "success",
+		logger.F("client_id", c.config.ID),
+		logger.F("batch", batch.Seq),
+		logger.F("bytes", len(payload)),
+		logger.F("compressed", len(compressed)),
+		logger.Ff("ratio", "%.2f", float64(len(payload))/float64(len(compressed))),
+	)
+	return protocol.NewCompressedMessage(protocol.MsgBatchBet, compressed)
+}
+
+// Run Reads the bets of the agency file, sends them to the server in
+// batches and then queries the agency winners. A report of the run is
+// returned even if it fails. Cancelling the context stops the client as soon
+// as possible, closing every open resource, and makes Run return the context
+// error
+func (c *Client) Run(ctx context.Context) (RunReport, error) {
+	start := time.Now()
+	c.report = RunReport{}
+
+	err := c.run(ctx)
+	c.Close()
+
+	report := c.report
+	report.Duration = time.Since(start)
+	report.log(c.config.ID, err)
+	return report, err
+}
+
+func (c *Client) run(ctx context.Context) error {
+	if c.config.BetsFile != "" {
+		c.rejected = newRowsFile(RejectedBetsPath(c.config.BetsFile))
+		defer func() {
+			if c.rejected.Opened() {
+				c.closeResource("rejected_file", c.rejected)
+			}
+			c.rejected = nil
+		}()
+	}
+
+	if c.config.OutboxDir != "" {
+		outbox, err := OpenOutbox(c.config.OutboxDir, c.config.OutboxFsync, c.config.OutboxSegmentSize)
+		if err != nil {
+			return categorize(ErrConfig, err)
+		}
+		c.outbox = outbox
+		defer func() {
+			c.closeResource("outbox", outbox)
+			c.outbox = nil
+		}()
+
+		if err := c.replayOutbox(ctx); err != nil {
+			log.Error("replay_outbox", "fail", logger.F("client_id", c.config.ID), logger.F("error", err))
+			return err
+		}
+	}
+
+	if err := c.sendBetsFile(ctx); err != nil {
+		log.Error("loop_finished", "fail",
+			logger.F("client_id", c.config.ID),
+			logger.F("error", redactor.RedactError(err)),
 		)
-		msg, err := bufio.NewReader(c.conn).ReadString('\n')
-		c.conn.Close()
+		return err
+	}
+	log.Info("loop_finished", "success", logger.F("client_id", c.config.ID))
+
+	winners, err := c.QueryWinners(ctx)
+	if err != nil {
+		log.Error("consulta_ganadores", "fail", logger.F("client_id", c.config.ID), logger.F("error", err))
+		return err
+	}
+	c.report.WinnersFound = len(winners)
+	return nil
+}
+
+// Send Validates the bets received as parameter and sends them to the server
+// in as many batches as needed, waiting for every batch to be acknowledged.
+// No bet is sent if any of them is invalid. Batches are numbered from
+// SendSeqBase on, after the ones sent by earlier clients of the agency if
+// a sequence file is configured
+func (c *Client) Send(ctx context.Context, bets ...Bet) error {
+	agency, err := c.agency()
+	if err != nil {
+		return err
+	}
+	for i, bet := range bets {
+		if err := bet.Validate(); err != nil {
+			return categorize(ErrInvalidBets, errors.Wrapf(err, "bet %d", i))
+		}
+	}
+
+	seq, err := c.sendSeq(agency)
+	if err != nil {
+		return err
+	}
+	builder, err := c.newBatchBuilder(ctx, agency, seq, c.config.BatchMaxAmount)
+	if err != nil {
+		return err
+	}
+	defer func() { c.nextSeq = builder.NextSeq() }()
+	for i := 0; i < len(bets); {
+		added, err := builder.Add(bets[i])
+		if err != nil {
+			return categorize(ErrInvalidBets, errors.Wrapf(err, "bet %d", i))
+		}
+		if added {
+			i++
+			continue
+		}
+		if err := c.sendNumberedBatch(ctx, agency, builder.Flush()); err != nil {
+			return err
+		}
+		builder.SetCompression(c.compressing())
+	}
+
+	if builder.Empty() {
+		return nil
+	}
+	return c.sendNumberedBatch(ctx, agency, builder.Flush())
+}
+
+// sendSeq Returns the sequence number of the next batch built by Send or
+// split from a larger one, which is the one stored in the sequence file if it
+// is ahead of the client
+func (c *Client) sendSeq(agency int) (uint64, error) {
+	if c.sequences == nil {
+		return c.nextSeq, nil
+	}
+	stored, err := c.sequences.Next(agency)
+	if err != nil {
+		return 0, err
+	}
+	if stored > c.nextSeq {
+		return stored, nil
+	}
+	return c.nextSeq, nil
+}
+
+// sendNumberedBatch Sends a batch built by Send, storing first that its
+// sequence number is taken, so it is not reused even if the client stops
+// before the batch is acknowledged
+func (c *Client) sendNumberedBatch(ctx context.Context, agency int, batch Batch) error {
+	if c.sequences != nil {
+		if err := c.sequences.Save(agency, batch.Seq+1); err != nil {
+			return err
+		}
+	}
+	return c.sendBatch(ctx, batch)
+}
+
+// sendBetsFile Streams the bets of the configured agency file to the server,
+// applying the invalid bet policy to the rows that cannot be sent. Batches
+// are numbered from the start of the file, or from the checkpoint if there
+// is one, so reading the same rows again produces the same batches
+func (c *Client) sendBetsFile(ctx context.Context) error {
+	agency, err := c.agency()
+	if err != nil {
+		return err
+	}
+
+	reader, err := NewBetReader(c.config.BetsFile, agency)
+	if err != nil {
+		return categorize(ErrConfig, err)
+	}
+	defer c.closeResource("bets_file", reader)
+
+	seq := uint64(1)
+	amount := c.config.BatchMaxAmount
+	if c.config.CheckpointFile != "" {
+		checkpointer, checkpoint, err := OpenCheckpointer(c.config.CheckpointFile, c.config.BetsFile, c.config.RestartFromScratch)
+		if err != nil {
+			return categorize(ErrConfig, err)
+		}
+		c.checkpointer = checkpointer
+		defer func() {
+			checkpointer.Close()
+			c.checkpointer = nil
+		}()
+
+		seq = checkpoint.NextSeq
+		if c.config.BatchAdaptive && checkpoint.BatchAmount > 0 {
+			amount = checkpoint.BatchAmount
+		}
+		if position := checkpoint.Position; position.Offset > 0 {
+			if err := reader.Seek(position); err != nil {
+				return err
+			}
+			log.Info("resume_checkpoint", "success",
+				logger.F("client_id", c.config.ID),
+				logger.F("line", position.Line),
+				logger.F("batch", seq),
+			)
+		}
+	}
+
+	invalidBets := NewInvalidBetHandler(c.config.ID, c.config.InvalidBetPolicy, c.config.QuarantineFile)
+	defer invalidBets.Close()
+
+	if c.config.BatchAdaptive {
+		c.sizer = NewBatchSizer(amount, c.config.BatchTargetLatency)
+		amount = c.sizer.Amount()
+		defer func() { c.sizer = nil }()
+	}
+
+	// Batches of the file are sized by their uncompressed payload, so the
+	// rows of a batch do not depend on what the server accepts and a
+	// resumed client builds the same batch for the same sequence number.
+	// They are still sent compressed when the server accepts it
+	builder := NewBatchBuilder(agency, seq, amount, c.batchBudget())
+	if !c.greeted {
+		// Pipelining depends on what the server accepts
+		if err := c.createClientSocket(ctx); err != nil {
+			return err
+		}
+	}
+
+	if window := c.config.BatchWindow; window > 1 {
+		if !c.features.Has(protocol.FeaturePipelining) {
+			log.Warning("pipeline", "fail",
+				logger.F("client_id", c.config.ID),
+				logger.F("window", window),
+				logger.F("error", "the server does not accept pipelining, sending one batch at a time"),
+			)
+		} else {
+			c.pipeline = newPipeline(c, window)
+			defer func() {
+				c.pipeline.close()
+				c.pipeline = nil
+			}()
+		}
+	}
+	// handled Position right after the last row that was added to the batch
+	// being built or discarded by the invalid bet policy
+	handled := reader.Position()
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		bet, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		c.report.BetsRead++
+
+		var parseErr *ParseError
+		if errors.As(err, &parseErr) {
+			err = invalidBets.HandleRecord(parseErr.Record, parseErr.Line, parseErr.Err)
+		} else if err == nil {
+			err = c.addBet(ctx, builder, invalidBets, bet, reader.Line(), handled)
+		}
+		if err != nil {
+			return err
+		}
+		handled = reader.Position()
+	}
+
+	if !builder.Empty() {
+		if err := c.submitBatch(ctx, builder, reader.Position()); err != nil {
+			return err
+		}
+	}
+	if c.pipeline != nil {
+		if err := c.pipeline.drain(ctx); err != nil {
+			return err
+		}
+	}
+	return c.saveCheckpoint(reader.Position(), builder.NextSeq())
+}
+
+// submitBatch Flushes the batch being built, whose rows end at position in
+// the agency file, and sends it, saving the checkpoint once it is
+// acknowledged. When pipelining the batch is only queued and acknowledged
+// later
+func (c *Client) submitBatch(ctx context.Context, builder *BatchBuilder, position ReaderPosition) error {
+	batch := builder.Flush()
+	if c.pipeline != nil {
+		return c.pipeline.submit(ctx, batch, position)
+	}
+	if err := c.sendSizedBatch(ctx, builder, batch); err != nil {
+		return err
+	}
+	return c.saveCheckpoint(position, builder.NextSeq())
+}
+
+// sendSizedBatch Sends the batch and, if adaptive sizing is enabled, adapts
+// the size of the next batches to how long the server took to acknowledge
+// it. A batch the server rejects for being too large is split in smaller
+// batches that are sent instead
+func (c *Client) sendSizedBatch(ctx context.Context, builder *BatchBuilder, batch Batch) error {
+	start := time.Now()
+	err := c.sendBatch(ctx, batch)
+	if c.sizer == nil {
+		return err
+	}
+
+	previous := c.sizer.Amount()
+	latency := time.Since(start)
+	if err != nil {
+		if !isBatchTooLarge(err) || !c.sizer.Shrink() {
+			return err
+		}
+		c.resizeBatches(builder, previous, resizeBatchTooLarge, latency)
+		return c.resendBets(ctx, builder, batch.Bets)
+	}
+
+	if reason := c.sizer.Observe(batch.Len(), latency); reason != "" {
+		c.resizeBatches(builder, previous, reason, latency)
+	}
+	return nil
+}
+
+// resendBets Sends again the bets of a batch that was too large in batches
+// of the current size
+func (c *Client) resendBets(ctx context.Context, builder *BatchBuilder, bets []Bet) error {
+	for i := 0; i < len(bets); {
+		added, err := builder.Add(bets[i])
+		if err != nil {
+			return err
+		}
+		if added {
+			i++
+			continue
+		}
+		if err := c.sendSizedBatch(ctx, builder, builder.Flush()); err != nil {
+			return err
+		}
+	}
+	return c.sendSizedBatch(ctx, builder, builder.Flush())
+}
+
+// resizeBatches Applies the amount of bets decided by the sizer to the
+// batches being built
+func (c *Client) resizeBatches(builder *BatchBuilder, previous int, reason string, latency time.Duration) {
+	builder.SetMaxAmount(c.sizer.Amount())
+	log.Info("resize_batch", "success",
+		logger.F("client_id", c.config.ID),
+		logger.F("previous_amount", previous),
+		logger.F("amount", c.sizer.Amount()),
+		logger.F("reason", reason),
+		logger.F("latency", latency),
+	)
+}
+
+// saveCheckpoint Records the position of the bets file up to which every
+// row has been handled and the sequence number of the batch that starts
+// there, if checkpoints are enabled
+func (c *Client) saveCheckpoint(position ReaderPosition, nextSeq uint64) error {
+	if c.checkpointer == nil {
+		return nil
+	}
+	batchAmount := 0
+	if c.sizer != nil {
+		batchAmount = c.sizer.Amount()
+	}
+	if err := c.checkpointer.Save(position, nextSeq, batchAmount); err != nil {
+		return err
+	}
+	log.Debug("checkpoint", "success",
+		logger.F("client_id", c.config.ID),
+		logger.F("line", position.Line),
+		logger.F("batch", nextSeq),
+	)
+	return nil
+}
+
+// addBet Validates the bet and adds it to the batch being built, sending the
+// batch first if the bet does not fit in it. handled is the position of the
+// bets file where the batch being built ends, recorded once it is acknowledged.
+// Invalid bets are handed to the invalid bet handler
+func (c *Client) addBet(ctx context.Context, builder *BatchBuilder, invalidBets *InvalidBetHandler, bet Bet, line int, handled ReaderPosition) error {
+	if err := bet.Validate(); err != nil {
+		return invalidBets.Handle(bet, line, err)
+	}
+
+	added, err := builder.Add(bet)
+	if err != nil {
+		return invalidBets.Handle(bet, line, err)
+	}
+	if added {
+		return nil
+	}
+
+	if err := c.submitBatch(ctx, builder, handled); err != nil {
+		return err
+	}
+	// Wait a time between sending one batch and the next one, unless they
+	// are pipelined, since the window is what paces them then
+	if c.pipeline == nil {
+		if err := sleepContext(ctx, c.config.LoopPeriod); err != nil {
+			return err
+		}
+	}
 
+	_, err = builder.Add(bet)
+	return err
+}
+
+// sendBatch Sends the batch and waits for the server to acknowledge it. If
+// the outbox is enabled the batch is stored before being sent
+func (c *Client) sendBatch(ctx context.Context, batch Batch) error {
+	var id uint64
+	if c.outbox != nil {
+		var err error
+		if id, err = c.outbox.Append(batch.Payload()); err != nil {
+			return err
+		}
+	}
+	return c.deliverStoredBatch(ctx, id, batch)
+}
+
+// deliverStoredBatch Sends a batch stored in the outbox with the id received
+// as parameter, marking it as acknowledged once the server answers it.
+// Rejected batches are marked too, since sending them again would get the
+// same answer. Without outbox the batch is only sent. A batch that does not
+// fit in the budget uncompressed is sent split in smaller batches
+func (c *Client) deliverStoredBatch(ctx context.Context, id uint64, batch Batch) error {
+	err := c.deliverBatch(ctx, batch)
+	if errors.Is(err, errSplitBatch) {
+		return c.sendSplitBatch(ctx, id, batch)
+	}
+	if c.outbox != nil && (err == nil || errors.Is(err, ErrServerRejectedBatch)) {
+		if ackErr := c.outbox.Ack(id); ackErr != nil && err == nil {
+			err = ackErr
+		}
+	}
+	return err
+}
+
+// sendSplitBatch Sends the bets of a batch that does not fit in the budget
+// uncompressed in smaller uncompressed batches, numbered like the batches
+// built by Send. With the outbox the smaller batches are stored, and the
+// original one marked as acknowledged, before any of them is sent, so a
+// client that stops halfway replays the ones not acknowledged yet instead
+// of splitting it again with new sequence numbers
+func (c *Client) sendSplitBatch(ctx context.Context, id uint64, batch Batch) error {
+	pieces, err := c.splitBatch(batch)
+	if err != nil {
+		return err
+	}
+	log.Info("split_batch", "success",
+		logger.F("client_id", c.config.ID),
+		logger.F("batch", batch.Seq),
+		logger.F("amount", batch.Len()),
+		logger.F("batches", len(pieces)),
+	)
+
+	ids := make([]uint64, len(pieces))
+	if c.outbox != nil {
+		for i, piece := range pieces {
+			if ids[i], err = c.outbox.Append(piece.Payload()); err != nil {
+				return err
+			}
+		}
+		if err := c.outbox.Ack(id); err != nil {
+			return err
+		}
+	}
+	for i, piece := range pieces {
+		if err := c.deliverStoredBatch(ctx, ids[i], piece); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitBatch Rebuilds the bets of the batch in uncompressed batches that
+// fit in the budget, taking their sequence numbers from the ones of Send
+func (c *Client) splitBatch(batch Batch) ([]Batch, error) {
+	seq, err := c.sendSeq(batch.Agency)
+	if err != nil {
+		return nil, err
+	}
+	builder := NewBatchBuilder(batch.Agency, seq, 0, c.batchBudget())
+	var pieces []Batch
+	for _, bet := range batch.Bets {
+		added, err := builder.Add(bet)
+		if err == nil && !added {
+			pieces = append(pieces, builder.Flush())
+			_, err = builder.Add(bet)
+		}
 		if err != nil {
-			log.Errorf("action: receive_message | result: fail | client_id: %v | error: %v",
-				c.config.ID,
-				err,
+			return nil, err
+		}
+	}
+	pieces = append(pieces, builder.Flush())
+
+	c.nextSeq = builder.NextSeq()
+	if c.sequences != nil {
+		if err := c.sequences.Save(batch.Agency, c.nextSeq); err != nil {
+			return nil, err
+		}
+	}
+	return pieces, nil
+}
+
+// replayOutbox Sends again the batches of the outbox that were not
+// acknowledged in a previous run
+func (c *Client) replayOutbox(ctx context.Context) error {
+	pending := c.outbox.Pending()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	log.Info("replay_outbox", "in_progress",
+		logger.F("client_id", c.config.ID),
+		logger.F("amount", len(pending)),
+	)
+	for _, entry := range pending {
+		batch, err := DecodeBatch(entry.Payload)
+		if err != nil {
+			log.Error("replay_outbox", "fail",
+				logger.F("client_id", c.config.ID),
+				logger.F("outbox_id", entry.ID),
+				logger.F("error", err),
 			)
-			return
+			if err := c.outbox.Ack(entry.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := c.deliverStoredBatch(ctx, entry.ID, batch); err != nil {
+			return err
 		}
+	}
+	log.Info("replay_outbox", "success",
+		logger.F("client_id", c.config.ID),
+		logger.F("amount", len(pending)),
+	)
+	return nil
+}
 
-		log.Infof("action: receive_message | result: success | client_id: %v | msg: %v",
-			c.config.ID,
-			msg,
+// deliverBatch Sends the batch and waits for the server to acknowledge it.
+// A batch the server had already stored, e.g. because the acknowledgement
+// of a previous attempt was lost, is taken as acknowledged. errSplitBatch
+// is returned if the batch does not fit in the budget uncompressed on the
+// current connection
+func (c *Client) deliverBatch(ctx context.Context, batch Batch) error {
+	if !c.greeted {
+		// Whether the batch is compressed depends on what the server accepts
+		if err := c.createClientSocket(ctx); err != nil {
+			return c.batchAnswered(batch, protocol.Message{}, err)
+		}
+	}
+	if c.needsSplit(batch) {
+		return errSplitBatch
+	}
+	response, err := c.request(ctx, c.batchMessage(batch))
+	if errors.Is(err, errCompressionNotAccepted) {
+		return c.deliverBatch(ctx, batch)
+	}
+	return c.batchAnswered(batch, response, err)
+}
+
+// batchAnswered Handles the response of the server to the batch, or the
+// error that prevented getting it, logging the result and updating the
+// report
+func (c *Client) batchAnswered(batch Batch, response protocol.Message, err error) error {
+	var rejections []BetRejection
+	if err == nil {
+		request := protocol.NewMessage(protocol.MsgBatchBet, batch.Payload())
+		rejections, err = expectBatchAck(request, response, batch)
+	}
+	if err != nil {
+		if errors.Is(err, ErrServerRejectedBatch) {
+			c.report.BatchesRejected++
+		}
+		log.Error("apuesta_enviada", "fail",
+			logger.F("client_id", c.config.ID),
+			logger.F("batch", batch.Seq),
+			logger.F("cantidad", batch.Len()),
+			logger.F("error", err),
+		)
+		return err
+	}
+	c.report.BatchesAcknowledged++
+	c.report.BetsSent += batch.Len() - len(rejections)
+	if err := c.handleRejections(batch, rejections); err != nil {
+		return err
+	}
+	if response.Kind == protocol.MsgDuplicateBatch {
+		c.report.BatchesDuplicated++
+		log.Info("apuesta_enviada", "success",
+			logger.F("client_id", c.config.ID),
+			logger.F("batch", batch.Seq),
+			logger.F("cantidad", batch.Len()),
+			logger.F("duplicado", true),
 		)
+		return nil
+	}
 
-		// Wait a time between sending one message and the next one
-		time.Sleep(c.config.LoopPeriod)
+	rejected := make(map[int]bool, len(rejections))
+	for _, rejection := range rejections {
+		rejected[rejection.Index] = true
+	}
+	for i, bet := range batch.Bets {
+		if rejected[i] {
+			continue
+		}
+		log.Debug("apuesta_enviada", "success",
+			logger.F("dni", redactor.Redact(bet.Document)),
+			logger.F("numero", bet.Number),
+		)
+	}
+	log.Info("apuesta_enviada", "success",
+		logger.F("client_id", c.config.ID),
+		logger.F("batch", batch.Seq),
+		logger.F("cantidad", batch.Len()-len(rejections)),
+		logger.F("rechazadas", len(rejections)),
+	)
+	return nil
+}
 
+// handleRejections Logs every bet of the batch that the server did not
+// store and writes it to the rejected bets file, if there is one, so it can
+// be fixed and sent again
+func (c *Client) handleRejections(batch Batch, rejections []BetRejection) error {
+	for _, rejection := range rejections {
+		bet := batch.Bets[rejection.Index]
+		c.report.BetsRejected++
+		log.Warning("apuesta_recibida", "fail",
+			logger.F("client_id", c.config.ID),
+			logger.F("batch", batch.Seq),
+			logger.F("index", rejection.Index),
+			logger.F("dni", redactor.Redact(bet.Document)),
+			logger.F("numero", bet.Number),
+			logger.F("reason", rejection.Reason),
+		)
+		if c.rejected == nil {
+			continue
+		}
+		if err := c.rejected.Write(bet.Record(), rejection.Reason.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryWinners Notifies the server that the agency has sent every bet and
+// asks for the documents of the agency winners, polling with exponential
+// backoff while the draw has not happened yet. The whole query is bounded
+// by the configured winners timeout
+func (c *Client) QueryWinners(ctx context.Context) ([]string, error) {
+	agency, err := c.agency()
+	if err != nil {
+		return nil, err
+	}
+	if c.config.WinnersTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.WinnersTimeout)
+		defer cancel()
+	}
+
+	agencyPayload := make([]byte, agencyIDSize)
+	binary.BigEndian.PutUint32(agencyPayload, uint32(agency))
+
+	if !c.finishedNotified {
+		request := protocol.NewMessage(protocol.MsgAgencyFinished, agencyPayload)
+		response, err := c.request(ctx, request)
+		if err == nil {
+			err = expectKind(request, response, protocol.MsgAck)
+		}
+		if err != nil {
+			return nil, errors.Wrap(deadlineError(err), "could not notify the server that the agency finished")
+		}
+		c.finishedNotified = true
+	}
+
+	backoff := NewBackoff(c.config.WinnersInitialBackoff, c.config.WinnersMaxBackoff, DefaultBackoffJitter)
+	for {
+		request := protocol.NewMessage(protocol.MsgWinnersQuery, agencyPayload)
+		response, err := c.request(ctx, request)
+		if err != nil {
+			return nil, deadlineError(err)
+		}
+
+		switch response.Kind {
+		case protocol.MsgWinnersResult:
+			winners, err := decodeWinners(response.Payload)
+			if err != nil {
+				return nil, categorize(ErrProtocol, err)
+			}
+			log.Info("consulta_ganadores", "success", logger.F("cant_ganadores", len(winners)))
+			return winners, nil
+		case protocol.MsgWinnersNotReady:
+			delay := backoff.Next()
+			log.Debug("consulta_ganadores", "in_progress",
+				logger.F("client_id", c.config.ID),
+				logger.F("retry_in", delay),
+			)
+			if err := sleepContext(ctx, delay); err != nil {
+				return nil, errors.Wrap(deadlineError(err), "winners were not ready in time")
+			}
+		default:
+			return nil, expectKind(request, response, protocol.MsgWinnersResult)
+		}
+	}
+}
+
+// deadlineError Marks err as a timeout if the deadline of the context
+// expired, wherever the client was waiting when it did
+func deadlineError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, ErrTimeout) {
+		return categorize(ErrTimeout, err)
+	}
+	return err
+}
+
+// request Sends the message and returns the response. In persistent mode
+// the connection is reused, and if the server closed it since the previous
+// message the message is sent again in a new connection. If the context is
+// cancelled while waiting, the connection is closed so the pending write or
+// read is unblocked
+func (c *Client) request(ctx context.Context, message protocol.Message) (protocol.Message, error) {
+	reused := c.conn != nil
+	response, err := c.exchange(ctx, message)
+	if err != nil && reused && ctx.Err() == nil && isConnectionClosed(err) {
+		log.Info("reconnect", "in_progress", logger.F("client_id", c.config.ID), logger.F("error", err))
+		c.report.Retries++
+		c.closeConnection()
+		response, err = c.exchange(ctx, message)
+	}
+
+	if err != nil && !errors.Is(err, errCompressionNotAccepted) {
+		c.closeConnection()
+	} else if err == nil && c.config.ConnectionMode == ConnectionPerMessage {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return response, err
+}
+
+// exchange Writes the message and reads the response in the current
+// connection, opening a new one if there is none
+func (c *Client) exchange(ctx context.Context, message protocol.Message) (protocol.Message, error) {
+	if c.conn == nil {
+		if err := c.createClientSocket(ctx); err != nil {
+			return protocol.Message{}, err
+		}
+		if message.Compressed && !c.compressing() {
+			return protocol.Message{}, errCompressionNotAccepted
+		}
+	}
+	conn := c.conn
+	message, err := c.seal(message)
+	if err != nil {
+		return protocol.Message{}, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if c.config.WriteTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+	}
+	if err := c.codec.WriteMessage(conn, message); err != nil {
+		return protocol.Message{}, c.networkError(ctx, "send_message", err)
+	}
+
+	if c.config.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(c.config.ReadTimeout))
+	}
+	response, err := c.codec.ReadMessage(conn)
+	if err != nil {
+		return protocol.Message{}, c.networkError(ctx, "receive_message", err)
+	}
+	return response, nil
+}
+
+// seal Signs the message if a secret is configured, otherwise it is
+// returned as it is
+func (c *Client) seal(message protocol.Message) (protocol.Message, error) {
+	if c.config.Secret == nil {
+		return message, nil
+	}
+	if c.signer == nil {
+		agency, err := c.agency()
+		if err != nil {
+			return protocol.Message{}, err
+		}
+		c.signer = auth.NewSigner(uint32(agency), c.config.Secret)
+	}
+	return c.signer.Sign(message), nil
+}
+
+// networkError Classifies and logs an error of the action received as
+// parameter. If the context was cancelled its error is returned instead,
+// since err is only a consequence of closing the connection
+func (c *Client) networkError(ctx context.Context, action string, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	err = classifyNetError(action, err)
+	if isProtocolError(err) {
+		err = categorize(ErrProtocol, err)
+	}
+	log.Error(action, "fail",
+		logger.F("client_id", c.config.ID),
+		logger.F("reason", failureReason(err)),
+		logger.F("error", err),
+	)
+	return err
+}
+
+// Close Closes the connection with the server, if there is one open
+func (c *Client) Close() error {
+	c.closeConnection()
+	return nil
+}
+
+// closeConnection Closes the current connection logging the result
+func (c *Client) closeConnection() {
+	if c.conn == nil {
+		return
+	}
+	c.closeResource("connection", c.conn)
+	c.conn = nil
+}
+
+// closeResource Closes the resource received as parameter logging the result
+func (c *Client) closeResource(name string, resource io.Closer) {
+	if err := resource.Close(); err != nil {
+		log.Error("close_"+name, "fail", logger.F("client_id", c.config.ID), logger.F("error", err))
+		return
+	}
+	log.Info("close_"+name, "success", logger.F("client_id", c.config.ID))
+}
+
+// agency Returns the client id as an agency number
+func (c *Client) agency() (int, error) {
+	agency, err := strconv.Atoi(c.config.ID)
+	if err != nil || agency <= 0 {
+		return 0, categorize(ErrConfig, errors.Errorf("client id must be a positive agency number, got %q", c.config.ID))
+	}
+	return agency, nil
+}
+
+// decodeWinners Decodes the payload of a winners result: the document of
+// every winner as a 4 bytes big-endian number
+func decodeWinners(payload []byte) ([]string, error) {
+	if len(payload)%4 != 0 {
+		return nil, errors.Errorf("winners payload length %d is not a multiple of 4", len(payload))
+	}
+	winners := make([]string, 0, len(payload)/4)
+	for offset := 0; offset < len(payload); offset += 4 {
+		winners = append(winners, strconv.FormatUint(uint64(binary.BigEndian.Uint32(payload[offset:offset+4])), 10))
+	}
+	return winners, nil
+}
+
+// expectKind Returns an error if the response to the request is not of the
+// expected kind. Error responses are turned into a *ServerError carrying the
+// reason sent by the server
+func expectKind(request protocol.Message, response protocol.Message, expected protocol.MessageKind) error {
+	switch response.Kind {
+	case expected:
+		return nil
+	case protocol.MsgError:
+		return &ServerError{Request: request.Kind, Reason: string(response.Payload)}
+	default:
+		return &UnexpectedResponseError{Request: request.Kind, Expected: expected, Got: response.Kind}
+	}
+}
+
+// expectBatchAck Returns an error if the response to the batch request is
+// not an acknowledgement, or a duplicate batch reply, carrying the sequence
+// number of the batch sent. The bets of the batch that the server rejected
+// are returned
+func expectBatchAck(request protocol.Message, response protocol.Message, batch Batch) ([]BetRejection, error) {
+	if response.Kind != protocol.MsgDuplicateBatch {
+		if err := expectKind(request, response, protocol.MsgAck); err != nil {
+			return nil, err
+		}
+	}
+	seq, rejections, err := decodeBatchAck(response.Payload, batch)
+	if err != nil {
+		return nil, categorize(ErrProtocol, err)
+	}
+	if seq != batch.Seq {
+		return nil, &BatchSeqMismatchError{Expected: batch.Seq, Got: seq}
 	}
-	log.Infof("action: loop_finished | result: success | client_id: %v", c.config.ID)
+	return rejections, nil
 }
@@ -0,0 +1,861 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/auth"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// fakeServer Answers every message it receives with the message returned by
+// handle, keeping each connection open until the client closes it. If greet
+// is set hellos are answered with acceptHello instead
+type fakeServer struct {
+	listener net.Listener
+	greet    bool
+	handle   func(protocol.Message) (protocol.Message, bool)
+	received chan protocol.Message
+}
+
+func newFakeServer(t *testing.T, handle func(protocol.Message) (protocol.Message, bool)) *fakeServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	return startFakeServer(t, listener, true, handle)
+}
+
+// newLegacyFakeServer Same as newFakeServer, for a server that predates the
+// hello and passes it to handle as any other message
+func newLegacyFakeServer(t *testing.T, handle func(protocol.Message) (protocol.Message, bool)) *fakeServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	return startFakeServer(t, listener, false, handle)
+}
+
+func startFakeServer(t *testing.T, listener net.Listener, greet bool, handle func(protocol.Message) (protocol.Message, bool)) *fakeServer {
+	server := &fakeServer{listener: listener, greet: greet, handle: handle, received: make(chan protocol.Message, 100)}
+	t.Cleanup(func() { listener.Close() })
+	go server.serve()
+	return server
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			codec := protocol.NewCodec(0)
+			for {
+				message, err := codec.ReadMessage(conn)
+				if err != nil {
+					return
+				}
+				var response protocol.Message
+				ok := true
+				if s.greet && message.Kind == protocol.MsgHello {
+					response = acceptHello(message)
+				} else {
+					s.received <- message
+					response, ok = s.handle(message)
+				}
+				if !ok {
+					continue
+				}
+				if err := codec.WriteMessage(conn, response); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func newTestClient(t *testing.T, address string) *Client {
+	t.Helper()
+	client, err := NewClient(ClientConfig{
+		ID:             "1",
+		ServerAddress:  address,
+		ConnectionMode: ConnectionPersistent,
+		Retry:          RetryPolicy{MaxAttempts: 1},
+		BatchMaxAmount: 2,
+		BatchMaxBytes:  DefaultBatchMaxBytes,
+
+		WinnersInitialBackoff: time.Millisecond,
+		WinnersMaxBackoff:     time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return client
+}
+
+// acceptHello Answers a hello selecting the newest version and accepting
+// every feature asked for
+func acceptHello(message protocol.Message) protocol.Message {
+	hello, err := protocol.DeserializeHello(message.Payload)
+	if err != nil {
+		return protocol.NewMessage(protocol.MsgError, []byte(err.Error()))
+	}
+	reply, _ := hello.Reply(protocol.MinVersion, protocol.MaxVersion, hello.Features)
+	return protocol.NewMessage(protocol.MsgHello, reply.Serialize())
+}
+
+func ackEverything(message protocol.Message) (protocol.Message, bool) {
+	if message.Kind == protocol.MsgHello {
+		return acceptHello(message), true
+	}
+	return ackWith(protocol.MsgAck, message), true
+}
+
+// ackWith Answers the message with a message of the kind received as
+// parameter, carrying the sequence number if the message is a batch
+func ackWith(kind protocol.MessageKind, message protocol.Message) protocol.Message {
+	if message.Kind != protocol.MsgBatchBet {
+		return protocol.NewMessage(kind, nil)
+	}
+	return protocol.NewMessage(kind, message.Payload[agencyIDSize:batchHeaderSize])
+}
+
+func TestSendSplitsBetsInBatches(t *testing.T) {
+	server := newFakeServer(t, ackEverything)
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+
+	bets := []Bet{newTestBet(), newTestBet(), newTestBet()}
+	if err := client.Send(context.Background(), bets...); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if message := <-server.received; message.Kind != protocol.MsgBatchBet {
+			t.Fatalf("expected a batch, got %v", message.Kind)
+		}
+	}
+}
+
+func TestSendNumbersBatchesAcrossCalls(t *testing.T) {
+	server := newFakeServer(t, ackEverything)
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := client.Send(context.Background(), newTestBet()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	for _, expected := range []uint64{SendSeqBase, SendSeqBase + 1} {
+		batch, err := DecodeBatch((<-server.received).Payload)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if batch.Agency != 1 || batch.Seq != expected {
+			t.Fatalf("expected batch %d of agency 1, got batch %d of agency %d", expected, batch.Seq, batch.Agency)
+		}
+	}
+}
+
+// storeOnce Answers batches like a server that stores every sequence
+// number of the agency once, sending the seqs stored to stored
+func storeOnce(stored chan<- uint64) func(protocol.Message) (protocol.Message, bool) {
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	return func(message protocol.Message) (protocol.Message, bool) {
+		batch, err := DecodeBatch(message.Payload)
+		if err != nil {
+			return ackEverything(message)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if seen[batch.Seq] {
+			return ackWith(protocol.MsgDuplicateBatch, message), true
+		}
+		seen[batch.Seq] = true
+		stored <- batch.Seq
+		return ackWith(protocol.MsgAck, message), true
+	}
+}
+
+func TestNewClientRejectsIncompatibleOptions(t *testing.T) {
+	configs := map[string]ClientConfig{
+		"window per message": {ConnectionMode: ConnectionPerMessage, BatchWindow: 4},
+		"adaptive window":    {ConnectionMode: ConnectionPersistent, BatchWindow: 4, BatchAdaptive: true},
+	}
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewClient(config); !errors.Is(err, ErrConfig) {
+				t.Fatalf("expected ErrConfig, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSendContinuesSequenceOfPreviousClients(t *testing.T) {
+	stored := make(chan uint64, 10)
+	server := newFakeServer(t, storeOnce(stored))
+	seqFile := filepath.Join(t.TempDir(), "batch-seq.json")
+
+	for i := 0; i < 2; i++ {
+		config := newTestClient(t, server.listener.Addr().String()).config
+		config.SeqFile = seqFile
+		client, err := NewClient(config)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := client.Send(context.Background(), newTestBet()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		client.Close()
+		if client.report.BatchesDuplicated != 0 {
+			t.Fatalf("expected client %d to send a new batch, got %+v", i, client.report)
+		}
+	}
+	if first, second := <-stored, <-stored; first != SendSeqBase || second != SendSeqBase+1 {
+		t.Fatalf("expected batches %d and %d to be stored, got %d and %d", SendSeqBase, SendSeqBase+1, first, second)
+	}
+}
+
+func TestSendAndBetsFileDoNotShareSequenceNumbers(t *testing.T) {
+	stored := make(chan uint64, 10)
+	server := newFakeServer(t, storeOnce(stored))
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	client.config.BetsFile = writeAgencyFile(t, "Santiago Lionel,Lorca,30904465,1999-03-17,2201\n")
+
+	if err := client.Send(context.Background(), newTestBet()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.sendBetsFile(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.report.BatchesDuplicated != 0 || len(stored) != 2 {
+		t.Fatalf("expected both batches to be stored, got %+v", client.report)
+	}
+}
+
+func TestSendTakesDuplicateBatchAsAcknowledged(t *testing.T) {
+	server := newFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+		return ackWith(protocol.MsgDuplicateBatch, message), true
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+
+	if err := client.Send(context.Background(), newTestBet()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.report.BatchesDuplicated != 1 || client.report.BetsSent != 1 {
+		t.Fatalf("expected the batch to be reported as duplicated, got %+v", client.report)
+	}
+}
+
+func TestSendWritesRejectedBets(t *testing.T) {
+	server := newFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+		ack := ackWith(protocol.MsgAck, message)
+		ack.Payload = append(ack.Payload, 0, 1, byte(RejectDuplicateBet))
+		return ack, true
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	path := filepath.Join(t.TempDir(), "agency-1.rejected.csv")
+	client.rejected = newRowsFile(path)
+
+	rejectedBet := newTestBet()
+	rejectedBet.Document = "12345678"
+	if err := client.Send(context.Background(), newTestBet(), rejectedBet); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	client.rejected.Close()
+
+	if client.report.BetsSent != 1 || client.report.BetsRejected != 1 {
+		t.Fatalf("expected 1 bet sent and 1 rejected, got %+v", client.report)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := "Santiago Lionel,Lorca,12345678,1999-03-17,2201,duplicate_bet\n"; string(data) != expected {
+		t.Fatalf("expected rejected rows %q, got %q", expected, data)
+	}
+}
+
+func TestSendRejectsAckOfAnotherBatch(t *testing.T) {
+	server := newFakeServer(t, func(protocol.Message) (protocol.Message, bool) {
+		payload := make([]byte, batchSeqSize)
+		binary.BigEndian.PutUint64(payload, 42)
+		return protocol.NewMessage(protocol.MsgAck, payload), true
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+
+	err := client.Send(context.Background(), newTestBet())
+	var mismatch *BatchSeqMismatchError
+	if !errors.As(err, &mismatch) || !errors.Is(err, ErrProtocol) {
+		t.Fatalf("expected *BatchSeqMismatchError, got %v", err)
+	}
+}
+
+func TestAdaptiveBatchesAreSplitWhenTooLarge(t *testing.T) {
+	server := newFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+		if batch, err := DecodeBatch(message.Payload); err == nil && batch.Len() > 1 {
+			return protocol.NewMessage(protocol.MsgError, []byte(ReasonBatchTooLarge)), true
+		}
+		return ackWith(protocol.MsgAck, message), true
+	})
+	betsFile := writeAgencyFile(t, strings.Repeat("Santiago Lionel,Lorca,30904465,1999-03-17,2201\n", 4))
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	client.config.BetsFile = betsFile
+	client.config.BatchMaxAmount = 4
+	client.config.BatchAdaptive = true
+	client.config.BatchTargetLatency = time.Minute
+
+	if err := client.sendBetsFile(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.report.BetsSent != 4 || client.report.BatchesRejected == 0 {
+		t.Fatalf("expected every bet to be sent after splitting the batches, got %+v", client.report)
+	}
+}
+
+func TestSendCompressesBatchesWhenNegotiated(t *testing.T) {
+	server := newFakeServer(t, ackEverything)
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	client.config.CompressionEnabled = true
+	client.config.BatchMaxAmount = 10
+
+	bets := make([]Bet, 10)
+	for i := range bets {
+		bets[i] = newTestBet()
+	}
+	if err := client.Send(context.Background(), bets...); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	batch, err := DecodeBatch((<-server.received).Payload)
+	if err != nil || batch.Len() != 10 {
+		t.Fatalf("expected the server to inflate a batch of 10 bets, got %v, %v", batch.Len(), err)
+	}
+	if client.report.CompressionRatio() <= 1 {
+		t.Fatalf("expected the batch to be sent compressed, got %+v", client.report)
+	}
+}
+
+// fillCompressedBatch Builds a batch sized by its compressed form that does
+// not fit in the budget raw
+func fillCompressedBatch(t *testing.T, seq uint64, budget int) Batch {
+	t.Helper()
+	builder := NewBatchBuilder(1, seq, 0, budget)
+	builder.SetCompression(true)
+	for {
+		added, err := builder.Add(newTestBet())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !added {
+			break
+		}
+	}
+	batch := builder.Flush()
+	if envelopeOverhead+len(batch.Payload()) <= budget {
+		t.Fatalf("expected the batch not to fit in %d bytes raw", budget)
+	}
+	return batch
+}
+
+// checkSplitBatches Reads the batches received by the server until bets bets
+// arrive, checking that every one of them was sent raw within the budget
+func checkSplitBatches(t *testing.T, server *fakeServer, bets int, budget int) {
+	t.Helper()
+	for received := 0; received < bets; {
+		message := <-server.received
+		if message.Compressed || envelopeOverhead+len(message.Payload) > budget {
+			t.Fatalf("expected a raw batch within %d bytes, got %d bytes", budget, envelopeOverhead+len(message.Payload))
+		}
+		batch, err := DecodeBatch(message.Payload)
+		if err != nil {
+			t.Fatalf("could not decode batch: %v", err)
+		}
+		received += batch.Len()
+	}
+}
+
+func TestReplaySplitsBatchesThatNoLongerFitUncompressed(t *testing.T) {
+	server := newFakeServer(t, ackEverything)
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	data, _ := newTestBet().Serialize()
+	client.config.BatchMaxBytes = batchOverhead + 3*(4+len(data))
+
+	outbox, err := OpenOutbox(t.TempDir(), FsyncNever, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer outbox.Close()
+	client.outbox = outbox
+	batch := fillCompressedBatch(t, 7, client.config.BatchMaxBytes)
+	if _, err := outbox.Append(batch.Payload()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The client restarted with compression disabled
+	if err := client.replayOutbox(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	checkSplitBatches(t, server, batch.Len(), client.config.BatchMaxBytes)
+	if client.report.BetsSent != batch.Len() {
+		t.Fatalf("expected the %d bets to be sent, got %+v", batch.Len(), client.report)
+	}
+	if pending := outbox.Pending(); len(pending) != 0 {
+		t.Fatalf("expected no pending batches, got %d", len(pending))
+	}
+}
+
+// replayTestOutbox Replays the outbox stored at dir with a new client of
+// the server, as a restarted client does
+func replayTestOutbox(ctx context.Context, t *testing.T, server *fakeServer, dir string, budget int) (*Client, error) {
+	t.Helper()
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	client.config.BatchMaxBytes = budget
+	outbox, err := OpenOutbox(dir, FsyncNever, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer outbox.Close()
+	client.outbox = outbox
+	return client, client.replayOutbox(ctx)
+}
+
+func TestReplayAfterCrashBetweenSplitBatchesSendsOnlyTheRest(t *testing.T) {
+	data, _ := newTestBet().Serialize()
+	budget := batchOverhead + 3*(4+len(data))
+	dir := t.TempDir()
+	outbox, err := OpenOutbox(dir, FsyncNever, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	batch := fillCompressedBatch(t, 7, budget)
+	if _, err := outbox.Append(batch.Payload()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	outbox.Close()
+
+	// The client stops while the second smaller batch is in flight
+	ctx, crash := context.WithCancel(context.Background())
+	defer crash()
+	var pieces int32
+	server := newFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+		if atomic.AddInt32(&pieces, 1) == 2 {
+			crash()
+			return protocol.Message{}, false
+		}
+		return ackEverything(message)
+	})
+	crashed, err := replayTestOutbox(ctx, t, server, dir, budget)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the client to be cancelled, got %v", err)
+	}
+	first, err := DecodeBatch((<-server.received).Payload)
+	if err != nil || first.Seq == batch.Seq || crashed.report.BetsSent != first.Len() {
+		t.Fatalf("expected only the first smaller batch to be acknowledged, got %+v, %v", crashed.report, err)
+	}
+
+	stored := make(chan uint64, 100)
+	server = newFakeServer(t, storeOnce(stored))
+	restarted, err := replayTestOutbox(context.Background(), t, server, dir, budget)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sent := crashed.report.BetsSent + restarted.report.BetsSent; sent != batch.Len() {
+		t.Fatalf("expected the %d bets to be sent once, got %d", batch.Len(), sent)
+	}
+	for len(stored) > 0 {
+		if seq := <-stored; seq == batch.Seq || seq == first.Seq {
+			t.Fatalf("expected batch %d not to be sent again", seq)
+		}
+	}
+}
+
+func TestSendSplitsBatchesWhenReconnectionDropsCompression(t *testing.T) {
+	var hellos int32
+	server := newLegacyFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+		if message.Kind != protocol.MsgHello {
+			return ackEverything(message)
+		}
+		// Only the first connection accepts compression
+		reply := protocol.HelloReply{Version: protocol.Version1}
+		if atomic.AddInt32(&hellos, 1) == 1 {
+			reply.Features = protocol.FeatureCompression
+		}
+		return protocol.NewMessage(protocol.MsgHello, reply.Serialize()), true
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	data, _ := newTestBet().Serialize()
+	client.config.ConnectionMode = ConnectionPerMessage
+	client.config.CompressionEnabled = true
+	client.config.BatchMaxAmount = 1000
+	client.config.BatchMaxBytes = batchOverhead + 3*(4+len(data))
+
+	bets := make([]Bet, 2*fillCompressedBatch(t, 1, client.config.BatchMaxBytes).Len())
+	for i := range bets {
+		bets[i] = newTestBet()
+	}
+	if err := client.Send(context.Background(), bets...); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.report.BetsSent != len(bets) {
+		t.Fatalf("expected the %d bets to be sent, got %+v", len(bets), client.report)
+	}
+}
+
+// receivedBatchSizes Amount of bets of every batch received by the server,
+// in the order they arrived
+func receivedBatchSizes(t *testing.T, server *fakeServer, batches int) []int {
+	t.Helper()
+	sizes := make([]int, batches)
+	for i := range sizes {
+		batch, err := DecodeBatch((<-server.received).Payload)
+		if err != nil {
+			t.Fatalf("could not decode batch: %v", err)
+		}
+		sizes[i] = batch.Len()
+	}
+	return sizes
+}
+
+func TestBetsFileBatchesDoNotDependOnCompression(t *testing.T) {
+	data, _ := newTestBet().Serialize()
+	budget := batchOverhead + 3*(4+len(data))
+	betsFile := writeAgencyFile(t, strings.Repeat("Santiago Lionel,Lorca,30904465,1999-03-17,2201\n", 7))
+
+	var sizes [][]int
+	for _, compression := range []bool{false, true} {
+		server := newFakeServer(t, ackEverything)
+		client := newTestClient(t, server.listener.Addr().String())
+		client.config.BetsFile = betsFile
+		client.config.BatchMaxAmount = 1000
+		client.config.BatchMaxBytes = budget
+		client.config.CompressionEnabled = compression
+
+		if err := client.sendBetsFile(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if client.compressing() != compression {
+			t.Fatalf("expected compression to be %v", compression)
+		}
+		client.Close()
+		sizes = append(sizes, receivedBatchSizes(t, server, client.report.BatchesAcknowledged))
+	}
+	if !reflect.DeepEqual(sizes[0], sizes[1]) || !reflect.DeepEqual(sizes[0], []int{3, 3, 1}) {
+		t.Fatalf("expected the same batches with and without compression, got %v", sizes)
+	}
+}
+
+func TestSendWithoutCompressionWhenServerPredatesHello(t *testing.T) {
+	server := newLegacyFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+		if message.Kind == protocol.MsgHello {
+			return protocol.NewMessage(protocol.MsgError, []byte("unknown message kind")), true
+		}
+		return ackEverything(message)
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	client.config.CompressionEnabled = true
+
+	if err := client.Send(context.Background(), newTestBet(), newTestBet()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.compressing() || client.report.BytesAfterCompression != 0 {
+		t.Fatalf("expected batches to be sent raw, got %+v", client.report)
+	}
+	if hello := <-server.received; hello.Kind != protocol.MsgHello {
+		t.Fatalf("expected a hello first, got %v", hello.Kind)
+	}
+}
+
+func TestSendFailsWhenServerRejectsHello(t *testing.T) {
+	server := newLegacyFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+		if message.Kind == protocol.MsgHello {
+			return protocol.NewMessage(protocol.MsgError, []byte("bad signature")), true
+		}
+		return ackEverything(message)
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+
+	err := client.Send(context.Background(), newTestBet())
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.Request != protocol.MsgHello || !errors.Is(err, ErrConfig) {
+		t.Fatalf("expected the rejected hello to be a config error, got %v", err)
+	}
+	if hello := <-server.received; hello.Kind != protocol.MsgHello || len(server.received) != 0 {
+		t.Fatalf("expected only the hello to be sent, got %v", hello.Kind)
+	}
+}
+
+func TestSendFailsWhenServerPredatesHelloAndSecretIsSet(t *testing.T) {
+	server := newLegacyFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+		return protocol.NewMessage(protocol.MsgError, []byte("unknown message kind")), true
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	client.config.Secret = []byte("secret")
+
+	err := client.Send(context.Background(), newTestBet())
+	if !errors.Is(err, ErrConfig) {
+		t.Fatalf("expected a config error, got %v", err)
+	}
+	if hello := <-server.received; hello.Kind != protocol.MsgSigned || len(server.received) != 0 {
+		t.Fatalf("expected only the signed hello to be sent, got %v", hello.Kind)
+	}
+}
+
+func TestConnectRetriesHelloWithoutAnswer(t *testing.T) {
+	var hellos int32
+	server := newLegacyFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+		if message.Kind != protocol.MsgHello {
+			return ackEverything(message)
+		}
+		// The first hello is never answered
+		return acceptHello(message), atomic.AddInt32(&hellos, 1) > 1
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	client.config.ReadTimeout = 50 * time.Millisecond
+	client.config.Retry = RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	if err := client.Send(context.Background(), newTestBet()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.report.Retries != 1 || client.report.BetsSent != 1 {
+		t.Fatalf("expected the bet to be sent after sending the hello again, got %+v", client.report)
+	}
+}
+
+func TestHelloCarriesAgencyAndBuild(t *testing.T) {
+	hellos := make(chan protocol.Hello, 1)
+	server := newLegacyFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+		if message.Kind != protocol.MsgHello {
+			return ackEverything(message)
+		}
+		hello, err := protocol.DeserializeHello(message.Payload)
+		if err != nil {
+			t.Errorf("could not decode hello: %v", err)
+		}
+		hellos <- hello
+		reply := protocol.HelloReply{Version: protocol.Version1, Features: protocol.FeatureCompression}
+		return protocol.NewMessage(protocol.MsgHello, reply.Serialize()), true
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	client.config.BuildVersion = "v1.2.3"
+	client.config.BatchWindow = 4
+
+	if err := client.Send(context.Background(), newTestBet()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hello := <-hellos
+	if hello.Agency != 1 || hello.Build != "v1.2.3" || hello.MaxVersion != protocol.MaxVersion {
+		t.Fatalf("unexpected hello %+v", hello)
+	}
+	if hello.Features != protocol.FeaturePipelining {
+		t.Fatalf("expected only pipelining to be asked for, got %v", hello.Features)
+	}
+	if client.features != 0 {
+		t.Fatalf("expected features not asked for to be ignored, got %v", client.features)
+	}
+}
+
+func TestHelloFailsWhenServerSelectsUnknownVersion(t *testing.T) {
+	server := newLegacyFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+		reply := protocol.HelloReply{Version: protocol.MaxVersion + 1}
+		return protocol.NewMessage(protocol.MsgHello, reply.Serialize()), true
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+
+	err := client.Send(context.Background(), newTestBet())
+	var unsupported *UnsupportedVersionError
+	if !errors.As(err, &unsupported) || !errors.Is(err, ErrProtocol) {
+		t.Fatalf("expected an *UnsupportedVersionError matching ErrProtocol, got %v", err)
+	}
+}
+
+func TestSendSignsEveryMessage(t *testing.T) {
+	secret := []byte("agency-secret")
+	verifier := auth.NewVerifier(map[uint32][]byte{1: secret}, time.Minute)
+	server := newFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+		envelope, err := verifier.Verify(message)
+		if err != nil {
+			return protocol.NewMessage(protocol.MsgError, []byte(err.Error())), true
+		}
+		return ackEverything(envelope.Message)
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	client.config.Secret = secret
+	client.config.BatchMaxBytes = 256
+
+	bets := []Bet{newTestBet(), newTestBet(), newTestBet()}
+	if err := client.Send(context.Background(), bets...); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if signed := <-server.received; signed.Kind != protocol.MsgSigned || len(signed.Serialize()) > 256 {
+			t.Fatalf("expected a signed message within the batch budget, got %v of %d bytes", signed.Kind, len(signed.Serialize()))
+		}
+	}
+}
+
+func TestSendReturnsServerError(t *testing.T) {
+	server := newFakeServer(t, func(protocol.Message) (protocol.Message, bool) {
+		return protocol.NewMessage(protocol.MsgError, []byte("invalid batch")), true
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+
+	err := client.Send(context.Background(), newTestBet())
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.Reason != "invalid batch" {
+		t.Fatalf("expected *ServerError, got %v", err)
+	}
+}
+
+func TestQueryWinnersPollsUntilReady(t *testing.T) {
+	queries := 0
+	server := newFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+		if message.Kind != protocol.MsgWinnersQuery {
+			return protocol.NewMessage(protocol.MsgAck, nil), true
+		}
+		queries++
+		if queries < 3 {
+			return protocol.NewMessage(protocol.MsgWinnersNotReady, nil), true
+		}
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, 30904465)
+		return protocol.NewMessage(protocol.MsgWinnersResult, payload), true
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+
+	winners, err := client.QueryWinners(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(winners) != 1 || winners[0] != "30904465" {
+		t.Fatalf("unexpected winners %v", winners)
+	}
+}
+
+func TestQueryWinnersTimesOutWaitingForAnswer(t *testing.T) {
+	server := newFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+		// Winners queries are never answered
+		return protocol.NewMessage(protocol.MsgAck, nil), message.Kind != protocol.MsgWinnersQuery
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	client.config.WinnersTimeout = 50 * time.Millisecond
+
+	_, err := client.QueryWinners(context.Background())
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to match ErrTimeout, got %v", err)
+	}
+}
+
+func TestCancelUnblocksPendingRead(t *testing.T) {
+	// The server never answers, so the client blocks reading the response
+	server := newFakeServer(t, func(protocol.Message) (protocol.Message, bool) {
+		return protocol.Message{}, false
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-server.received
+		cancel()
+	}()
+
+	errs := make(chan error, 1)
+	go func() { errs <- client.Send(ctx, newTestBet()) }()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send was not unblocked by the cancellation")
+	}
+}
+
+// freeAddress Returns an address nothing listens on
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	return address
+}
+
+func TestConnectRetriesUntilServerIsUp(t *testing.T) {
+	address := freeAddress(t)
+	client := newTestClient(t, address)
+	defer client.Close()
+	client.config.Retry = RetryPolicy{MaxAttempts: 50, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			t.Errorf("could not listen: %v", err)
+			return
+		}
+		startFakeServer(t, listener, true, ackEverything)
+	}()
+
+	if err := client.Send(context.Background(), newTestBet()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.report.Retries == 0 {
+		t.Fatalf("expected the connection to be retried, got %+v", client.report)
+	}
+}
+
+func TestConnectGivesUpAfterMaxAttempts(t *testing.T) {
+	client := newTestClient(t, freeAddress(t))
+	defer client.Close()
+	client.config.Retry = RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	err := client.Send(context.Background(), newTestBet())
+	if !errors.Is(err, ErrServerUnavailable) {
+		t.Fatalf("expected ErrServerUnavailable, got %v", err)
+	}
+	if client.report.Retries != 2 {
+		t.Fatalf("expected 2 retries before giving up, got %d", client.report.Retries)
+	}
+}
@@ -0,0 +1,139 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// ConnectionMode Decides whether connections with the server are reused
+type ConnectionMode string
+
+// Supported connection modes
+const (
+	// ConnectionPersistent A single connection is reused for every message
+	ConnectionPersistent ConnectionMode = "persistent"
+	// ConnectionPerMessage A new connection is opened for every message
+	ConnectionPerMessage ConnectionMode = "per-message"
+)
+
+// ParseConnectionMode Parses the mode received as a string. An error is
+// returned if the mode is not supported
+func ParseConnectionMode(mode string) (ConnectionMode, error) {
+	switch m := ConnectionMode(mode); m {
+	case ConnectionPersistent, ConnectionPerMessage:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown connection mode %q, expected persistent or per-message", mode)
+	}
+}
+
+// connection Wraps a net.Conn so it can be safely closed more than once,
+// e.g. both by the goroutine watching for cancellation and by the client
+type connection struct {
+	net.Conn
+	once     sync.Once
+	closeErr error
+}
+
+func newConnection(conn net.Conn) *connection {
+	return &connection{Conn: conn}
+}
+
+// Close Closes the underlying connection the first time it is called
+func (c *connection) Close() error {
+	c.once.Do(func() {
+		c.closeErr = c.Conn.Close()
+	})
+	return c.closeErr
+}
+
+// TimeoutError Returned when an operation on the connection with the server
+// does not finish before its deadline
+type TimeoutError struct {
+	Op  string
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timeout: %v", e.Op, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Is Makes timeouts match ErrTimeout
+func (e *TimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// ConnectionLostError Returned when the server closes or resets the
+// connection in the middle of an operation
+type ConnectionLostError struct {
+	Op  string
+	Err error
+}
+
+func (e *ConnectionLostError) Error() string {
+	return fmt.Sprintf("connection lost during %s: %v", e.Op, e.Err)
+}
+
+func (e *ConnectionLostError) Unwrap() error {
+	return e.Err
+}
+
+// Is Makes lost connections match ErrServerUnavailable
+func (e *ConnectionLostError) Is(target error) bool {
+	return target == ErrServerUnavailable
+}
+
+// classifyNetError Wraps err in a *TimeoutError or a *ConnectionLostError
+// when it is one of those failures. Other errors are returned as they are
+func classifyNetError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &TimeoutError{Op: op, Err: err}
+	}
+	if isConnectionClosed(err) {
+		return &ConnectionLostError{Op: op, Err: err}
+	}
+	return err
+}
+
+// failureReason Short description of err used in logs
+func failureReason(err error) string {
+	var timeoutErr *TimeoutError
+	var lostErr *ConnectionLostError
+	switch {
+	case errors.As(err, &timeoutErr):
+		return "timeout"
+	case errors.As(err, &lostErr):
+		return "connection_lost"
+	default:
+		return "error"
+	}
+}
+
+// isNetworkFailure Returns true if err is a timeout or a lost connection,
+// so the operation can be attempted again in a new connection
+func isNetworkFailure(err error) bool {
+	var timeoutErr *TimeoutError
+	var lostErr *ConnectionLostError
+	return errors.As(err, &timeoutErr) || errors.As(err, &lostErr)
+}
+
+// isConnectionClosed Returns true if err means the peer closed the
+// connection, so the message can be sent again in a new connection
+func isConnectionClosed(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+func TestClassifyNetError(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	timeout := &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	other := errors.New("other")
+
+	tests := []struct {
+		name      string
+		err       error
+		category  error
+		reason    string
+		reconnect bool
+	}{
+		{name: "eof", err: io.EOF, category: ErrServerUnavailable, reason: "connection_lost", reconnect: true},
+		{name: "reset", err: reset, category: ErrServerUnavailable, reason: "connection_lost", reconnect: true},
+		{name: "broken pipe", err: syscall.EPIPE, category: ErrServerUnavailable, reason: "connection_lost", reconnect: true},
+		{name: "deadline", err: timeout, category: ErrTimeout, reason: "timeout", reconnect: false},
+		{name: "other", err: other, category: nil, reason: "error", reconnect: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := classifyNetError("receive", test.err)
+			if test.category != nil && !errors.Is(err, test.category) {
+				t.Fatalf("expected %v to match %v", err, test.category)
+			}
+			if test.category == nil && err != test.err {
+				t.Fatalf("expected the error to be kept, got %v", err)
+			}
+			if reason := failureReason(err); reason != test.reason {
+				t.Fatalf("expected reason %s, got %s", test.reason, reason)
+			}
+			if reconnect := isConnectionClosed(err); reconnect != test.reconnect {
+				t.Fatalf("expected reconnect to be %v, got %v", test.reconnect, reconnect)
+			}
+		})
+	}
+}
+
+func TestReadDeadlineIsTimeoutAndIsNotRetried(t *testing.T) {
+	messages := 0
+	server := newFakeServer(t, func(protocol.Message) (protocol.Message, bool) {
+		// Only the first message is answered
+		messages++
+		return protocol.NewMessage(protocol.MsgAck, nil), messages == 1
+	})
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	client.config.ReadTimeout = 50 * time.Millisecond
+
+	message := protocol.NewMessage(protocol.MsgAgencyFinished, nil)
+	if _, err := client.request(context.Background(), message); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err := client.request(context.Background(), message)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || !errors.Is(err, ErrTimeout) || errors.Is(err, ErrServerUnavailable) {
+		t.Fatalf("expected a *TimeoutError matching only ErrTimeout, got %v", err)
+	}
+	if len(server.received) != 2 {
+		t.Fatalf("expected the timed out message not to be sent again, got %d messages", len(server.received))
+	}
+}
+
+func TestRequestReconnectsWhenServerClosesConnection(t *testing.T) {
+	connections := make(chan int, 2)
+	address := newScriptedServer(t, func(t *testing.T, conn net.Conn, index int) {
+		// Every connection answers a single batch and is closed
+		for _, batch := range readBatches(t, conn, 1) {
+			answerBatch(conn, protocol.MsgAck, batch)
+			connections <- index
+		}
+	})
+	client := newTestClient(t, address)
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := client.Send(context.Background(), newTestBet()); err != nil {
+			t.Fatalf("unexpected error sending batch %d: %v", i, err)
+		}
+	}
+	for expected := 0; expected < 2; expected++ {
+		if index := <-connections; index != expected {
+			t.Fatalf("expected batch %d to be answered in connection %d, got %d", expected, expected, index)
+		}
+	}
+	if client.report.Retries != 1 || client.report.BetsSent != 2 {
+		t.Fatalf("expected both bets to be sent after one reconnection, got %+v", client.report)
+	}
+}
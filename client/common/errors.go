@@ -0,0 +1,172 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// Categories of the errors returned by the client, to be checked with
+// errors.Is. An error may match more than one category, e.g. a connection
+// that could not be opened because of a timeout
+var (
+	// ErrConfig The client configuration is not valid
+	ErrConfig = errors.New("invalid configuration")
+	// ErrInvalidBets The agency file has bets that the invalid bet policy did
+	// not allow to skip
+	ErrInvalidBets = errors.New("invalid bets")
+	// ErrServerUnavailable The server could not be reached or closed the connection
+	ErrServerUnavailable = errors.New("server unavailable")
+	// ErrTimeout The server did not answer in time
+	ErrTimeout = errors.New("timeout")
+	// ErrProtocol The server sent something the client does not understand
+	ErrProtocol = errors.New("protocol error")
+	// ErrServerRejectedBatch The server answered a batch with an error
+	ErrServerRejectedBatch = errors.New("server rejected batch")
+)
+
+// errSplitBatch Returned when a batch does not fit in the budget
+// uncompressed and the current connection does not accept compression, so
+// it has to be sent split in smaller batches
+var errSplitBatch = errors.New("batch does not fit in the budget uncompressed")
+
+// errCompressionNotAccepted Returned when a compressed message was about to
+// be sent on a new connection that does not accept compression, so it has
+// to be built again
+var errCompressionNotAccepted = errors.New("the connection does not accept compression")
+
+// categorizedError Attaches one of the error categories to an error
+type categorizedError struct {
+	category error
+	err      error
+}
+
+// categorize Returns err marked as belonging to the category received as
+// parameter, keeping its message
+func categorize(category error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &categorizedError{category: category, err: err}
+}
+
+func (e *categorizedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *categorizedError) Unwrap() error {
+	return e.err
+}
+
+func (e *categorizedError) Is(target error) bool {
+	return target == e.category
+}
+
+// isProtocolError Returns true if err is one of the decoding errors of the
+// protocol package
+func isProtocolError(err error) bool {
+	var truncated *protocol.TruncatedFrameError
+	var tooLarge *protocol.FrameTooLargeError
+	var unknownKind *protocol.UnknownKindError
+	var malformed *protocol.MalformedMessageError
+	var decompressedTooLarge *protocol.DecompressedTooLargeError
+	return errors.As(err, &truncated) ||
+		errors.As(err, &tooLarge) ||
+		errors.As(err, &unknownKind) ||
+		errors.As(err, &malformed) ||
+		errors.As(err, &decompressedTooLarge)
+}
+
+// ServerError Returned when the server answers a request with an error
+// message
+type ServerError struct {
+	Request protocol.MessageKind
+	Reason  string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server rejected %v request: %s", e.Request, e.Reason)
+}
+
+// Is Makes rejected batches match ErrServerRejectedBatch, and rejected
+// hellos match ErrConfig, since the server only rejects a hello if it does
+// not know the agency or its signature is wrong
+func (e *ServerError) Is(target error) bool {
+	return (target == ErrServerRejectedBatch && e.Request == protocol.MsgBatchBet) ||
+		(target == ErrConfig && e.Request == protocol.MsgHello)
+}
+
+// ReasonBatchTooLarge Reason sent by the server when it rejects a batch
+// because of its size
+const ReasonBatchTooLarge = "batch_too_large"
+
+// ReasonUnknownKind Reason sent by the server when it does not know the
+// kind of a message, followed by the kind
+const ReasonUnknownKind = "unknown message kind"
+
+// isUnknownKind Returns true if the reason of an error response means the
+// server does not know the kind of the message, as a server that predates
+// the hello answers it
+func isUnknownKind(reason []byte) bool {
+	return strings.HasPrefix(string(reason), ReasonUnknownKind)
+}
+
+// isBatchTooLarge Returns true if the server rejected a batch because of
+// its size
+func isBatchTooLarge(err error) bool {
+	var serverErr *ServerError
+	return errors.As(err, &serverErr) && serverErr.Request == protocol.MsgBatchBet && serverErr.Reason == ReasonBatchTooLarge
+}
+
+// UnexpectedResponseError Returned when the server answers a request with a
+// message of a kind that is not valid for that request
+type UnexpectedResponseError struct {
+	Request  protocol.MessageKind
+	Expected protocol.MessageKind
+	Got      protocol.MessageKind
+}
+
+func (e *UnexpectedResponseError) Error() string {
+	return fmt.Sprintf("expected a %v response to the %v request, got %v", e.Expected, e.Request, e.Got)
+}
+
+// Is Makes unexpected responses match ErrProtocol
+func (e *UnexpectedResponseError) Is(target error) bool {
+	return target == ErrProtocol
+}
+
+// UnsupportedVersionError Returned when the server selects a version of
+// the protocol the client does not speak
+type UnsupportedVersionError struct {
+	Version protocol.Version
+	Min     protocol.Version
+	Max     protocol.Version
+}
+
+func (e *UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("server selected protocol version %d, client speaks %d to %d", e.Version, e.Min, e.Max)
+}
+
+// Is Makes unsupported versions match ErrProtocol
+func (e *UnsupportedVersionError) Is(target error) bool {
+	return target == ErrProtocol
+}
+
+// BatchSeqMismatchError Returned when the server acknowledges a batch with
+// a sequence number other than the one of the batch sent
+type BatchSeqMismatchError struct {
+	Expected uint64
+	Got      uint64
+}
+
+func (e *BatchSeqMismatchError) Error() string {
+	return fmt.Sprintf("expected the acknowledgement of batch %d, got batch %d", e.Expected, e.Got)
+}
+
+// Is Makes mismatched acknowledgements match ErrProtocol
+func (e *BatchSeqMismatchError) Is(target error) bool {
+	return target == ErrProtocol
+}
@@ -0,0 +1,340 @@
+package common
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/logger"
+)
+
+// FsyncPolicy Decides when the outbox forces its writes to disk
+type FsyncPolicy string
+
+// Supported fsync policies
+const (
+	// FsyncAlways Every record is synced before the write returns
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncNever Syncing is left to the operating system
+	FsyncNever FsyncPolicy = "never"
+)
+
+// ParseFsyncPolicy Parses the policy received as a string. An error is
+// returned if the policy is not supported
+func ParseFsyncPolicy(policy string) (FsyncPolicy, error) {
+	switch p := FsyncPolicy(policy); p {
+	case FsyncAlways, FsyncNever:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown fsync policy %q, expected always or never", policy)
+	}
+}
+
+// DefaultOutboxSegmentSize Size in bytes after which the outbox starts a
+// new segment file
+const DefaultOutboxSegmentSize = 1024 * 1024
+
+// Kinds of records stored in the outbox
+const (
+	outboxRecordBatch byte = iota + 1
+	outboxRecordAck
+)
+
+// outboxRecordHeaderSize Size of the kind (1 byte), the batch id (8 bytes)
+// and the data length (4 bytes) of a record. Records end with a crc32 of
+// everything that precedes it
+const outboxRecordHeaderSize = 13
+const outboxRecordChecksumSize = 4
+
+// outboxMaxRecordSize Largest batch payload the outbox stores. Well above
+// any batch, even uncompressed, so a larger length read from a record
+// header can only come from a corrupted record
+const outboxMaxRecordSize = 16 * 1024 * 1024
+
+// OutboxEntry A batch stored in the outbox
+type OutboxEntry struct {
+	ID      uint64
+	Payload []byte
+}
+
+// Outbox Durable append-only log of the batches sent to the server. Every
+// batch is stored before being sent and marked as acknowledged once the
+// server confirms it, so unacknowledged batches can be replayed after a
+// restart. The log is split in segment files, and segments whose batches
+// were all acknowledged are removed by Compact
+type Outbox struct {
+	dir         string
+	fsync       FsyncPolicy
+	segmentSize int64
+
+	current      *os.File
+	currentIndex int
+	currentSize  int64
+
+	nextID   uint64
+	pending  map[uint64]OutboxEntry
+	segments map[int]int
+	location map[uint64]int
+}
+
+// OpenOutbox Opens the outbox stored in dir, creating it if it does not
+// exist, and loads the batches that were not acknowledged
+func OpenOutbox(dir string, fsync FsyncPolicy, segmentSize int64) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "could not create outbox directory %s", dir)
+	}
+	if segmentSize <= 0 {
+		segmentSize = DefaultOutboxSegmentSize
+	}
+
+	o := &Outbox{
+		dir:         dir,
+		fsync:       fsync,
+		segmentSize: segmentSize,
+		nextID:      1,
+		pending:     make(map[uint64]OutboxEntry),
+		segments:    make(map[int]int),
+		location:    make(map[uint64]int),
+	}
+
+	indexes, err := o.segmentIndexes()
+	if err != nil {
+		return nil, err
+	}
+	for _, index := range indexes {
+		if err := o.load(index); err != nil {
+			return nil, err
+		}
+	}
+
+	next := 0
+	if len(indexes) > 0 {
+		next = indexes[len(indexes)-1] + 1
+	}
+	if err := o.openSegment(next); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Pending Returns the batches that were not acknowledged, oldest first
+func (o *Outbox) Pending() []OutboxEntry {
+	entries := make([]OutboxEntry, 0, len(o.pending))
+	for _, entry := range o.pending {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+// Append Stores the batch payload and returns the id assigned to it
+func (o *Outbox) Append(payload []byte) (uint64, error) {
+	if len(payload) > outboxMaxRecordSize {
+		return 0, errors.Errorf("batch of %d bytes exceeds the outbox limit of %d", len(payload), outboxMaxRecordSize)
+	}
+	if o.currentSize >= o.segmentSize {
+		if err := o.rollover(); err != nil {
+			return 0, err
+		}
+	}
+
+	id := o.nextID
+	if err := o.write(outboxRecordBatch, id, payload); err != nil {
+		return 0, err
+	}
+	o.nextID++
+	o.pending[id] = OutboxEntry{ID: id, Payload: payload}
+	o.location[id] = o.currentIndex
+	o.segments[o.currentIndex]++
+	return id, nil
+}
+
+// Ack Marks the batch as acknowledged by the server
+func (o *Outbox) Ack(id uint64) error {
+	if _, ok := o.pending[id]; !ok {
+		return nil
+	}
+	if err := o.write(outboxRecordAck, id, nil); err != nil {
+		return err
+	}
+	o.forget(id)
+	return nil
+}
+
+// Compact Removes the oldest segments whose batches were all acknowledged.
+// Segments are only removed in order, since acknowledgements are always
+// stored in the same segment as their batch or in a later one
+func (o *Outbox) Compact() error {
+	indexes, err := o.segmentIndexes()
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if index == o.currentIndex || o.segments[index] > 0 {
+			break
+		}
+		if err := os.Remove(o.segmentPath(index)); err != nil {
+			return errors.Wrapf(err, "could not remove outbox segment %d", index)
+		}
+		delete(o.segments, index)
+		log.Debug("compact_outbox", "success", logger.F("segment", index))
+	}
+	return nil
+}
+
+// Close Compacts the outbox and closes the current segment
+func (o *Outbox) Close() error {
+	if o.current == nil {
+		return nil
+	}
+	if err := o.Compact(); err != nil {
+		o.current.Close()
+		o.current = nil
+		return err
+	}
+	err := o.current.Close()
+	o.current = nil
+	return err
+}
+
+// forget Drops the batch from the pending ones
+func (o *Outbox) forget(id uint64) {
+	delete(o.pending, id)
+	if index, ok := o.location[id]; ok {
+		o.segments[index]--
+		delete(o.location, id)
+	}
+}
+
+// write Appends a record to the current segment
+func (o *Outbox) write(kind byte, id uint64, data []byte) error {
+	record := make([]byte, outboxRecordHeaderSize+len(data)+outboxRecordChecksumSize)
+	record[0] = kind
+	binary.BigEndian.PutUint64(record[1:9], id)
+	binary.BigEndian.PutUint32(record[9:outboxRecordHeaderSize], uint32(len(data)))
+	copy(record[outboxRecordHeaderSize:], data)
+	checksumOffset := len(record) - outboxRecordChecksumSize
+	binary.BigEndian.PutUint32(record[checksumOffset:], crc32.ChecksumIEEE(record[:checksumOffset]))
+
+	if _, err := o.current.Write(record); err != nil {
+		return errors.Wrap(err, "could not write outbox record")
+	}
+	o.currentSize += int64(len(record))
+	if o.fsync == FsyncAlways {
+		if err := o.current.Sync(); err != nil {
+			return errors.Wrap(err, "could not sync outbox")
+		}
+	}
+	return nil
+}
+
+// load Reads every record of a segment. A truncated or corrupted record,
+// e.g. from a crash in the middle of a write, ends the segment. The length
+// in the header is checked before the data is read, since the checksum can
+// only be verified afterwards
+func (o *Outbox) load(index int) error {
+	file, err := os.Open(o.segmentPath(index))
+	if err != nil {
+		return errors.Wrapf(err, "could not open outbox segment %d", index)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, outboxRecordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return nil
+		}
+		length := binary.BigEndian.Uint32(header[9:])
+		if length > outboxMaxRecordSize {
+			log.Warning("load_outbox", "fail",
+				logger.F("segment", index),
+				logger.F("error", "corrupted record"),
+			)
+			return nil
+		}
+		rest := make([]byte, int(length)+outboxRecordChecksumSize)
+		if _, err := io.ReadFull(reader, rest); err != nil {
+			log.Warning("load_outbox", "fail",
+				logger.F("segment", index),
+				logger.F("error", "truncated record"),
+			)
+			return nil
+		}
+
+		data := rest[:len(rest)-outboxRecordChecksumSize]
+		checksum := crc32.ChecksumIEEE(header)
+		checksum = crc32.Update(checksum, crc32.IEEETable, data)
+		if checksum != binary.BigEndian.Uint32(rest[len(data):]) {
+			log.Warning("load_outbox", "fail",
+				logger.F("segment", index),
+				logger.F("error", "corrupted record"),
+			)
+			return nil
+		}
+
+		id := binary.BigEndian.Uint64(header[1:9])
+		switch header[0] {
+		case outboxRecordBatch:
+			o.pending[id] = OutboxEntry{ID: id, Payload: data}
+			o.location[id] = index
+			o.segments[index]++
+		case outboxRecordAck:
+			o.forget(id)
+		}
+		if id >= o.nextID {
+			o.nextID = id + 1
+		}
+	}
+}
+
+// rollover Closes the current segment and starts a new one
+func (o *Outbox) rollover() error {
+	if err := o.current.Close(); err != nil {
+		return errors.Wrap(err, "could not close outbox segment")
+	}
+	if err := o.openSegment(o.currentIndex + 1); err != nil {
+		return err
+	}
+	return o.Compact()
+}
+
+func (o *Outbox) openSegment(index int) error {
+	file, err := os.OpenFile(o.segmentPath(index), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "could not open outbox segment %d", index)
+	}
+	o.current = file
+	o.currentIndex = index
+	o.currentSize = 0
+	return nil
+}
+
+func (o *Outbox) segmentPath(index int) string {
+	return filepath.Join(o.dir, fmt.Sprintf("segment-%08d.log", index))
+}
+
+// segmentIndexes Returns the indexes of the segments in the directory,
+// oldest first
+func (o *Outbox) segmentIndexes() ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(o.dir, "segment-*.log"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list outbox directory %s", o.dir)
+	}
+	indexes := make([]int, 0, len(paths))
+	for _, path := range paths {
+		var index int
+		if _, err := fmt.Sscanf(filepath.Base(path), "segment-%d.log", &index); err == nil {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+	return indexes, nil
+}
@@ -0,0 +1,115 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOutboxKeepsUnacknowledgedBatchesAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	outbox, err := OpenOutbox(dir, FsyncAlways, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first, _ := outbox.Append([]byte("first"))
+	second, _ := outbox.Append([]byte("second"))
+	if err := outbox.Ack(first); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	outbox.Close()
+
+	reopened, err := OpenOutbox(dir, FsyncAlways, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer reopened.Close()
+
+	pending := reopened.Pending()
+	if len(pending) != 1 || pending[0].ID != second || !bytes.Equal(pending[0].Payload, []byte("second")) {
+		t.Fatalf("expected only the second batch to be pending, got %+v", pending)
+	}
+	if id, _ := reopened.Append([]byte("third")); id <= second {
+		t.Fatalf("expected ids to keep growing after a restart, got %d", id)
+	}
+}
+
+func TestOutboxIgnoresTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	outbox, _ := OpenOutbox(dir, FsyncNever, 0)
+	outbox.Append([]byte("complete"))
+	outbox.Append([]byte("torn"))
+	outbox.current.Close()
+	outbox.current = nil
+
+	path := filepath.Join(dir, "segment-00000000.log")
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-2); err != nil {
+		t.Fatalf("could not truncate segment: %v", err)
+	}
+
+	reopened, err := OpenOutbox(dir, FsyncNever, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer reopened.Close()
+	if pending := reopened.Pending(); len(pending) != 1 || string(pending[0].Payload) != "complete" {
+		t.Fatalf("expected only the complete batch to be pending, got %+v", pending)
+	}
+}
+
+func TestOutboxIgnoresRecordWithCorruptedLength(t *testing.T) {
+	dir := t.TempDir()
+	outbox, _ := OpenOutbox(dir, FsyncNever, 0)
+	outbox.Append([]byte("complete"))
+	outbox.Close()
+
+	// A header announcing a record of 4 GiB
+	header := make([]byte, outboxRecordHeaderSize)
+	header[0] = outboxRecordBatch
+	binary.BigEndian.PutUint64(header[1:9], 2)
+	binary.BigEndian.PutUint32(header[9:], math.MaxUint32)
+	file, err := os.OpenFile(filepath.Join(dir, "segment-00000000.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("could not open segment: %v", err)
+	}
+	file.Write(header)
+	file.Close()
+
+	reopened, err := OpenOutbox(dir, FsyncNever, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer reopened.Close()
+	if pending := reopened.Pending(); len(pending) != 1 || string(pending[0].Payload) != "complete" {
+		t.Fatalf("expected only the complete batch to be pending, got %+v", pending)
+	}
+	if _, err := reopened.Append(make([]byte, outboxMaxRecordSize+1)); err == nil {
+		t.Fatal("expected a batch above the limit to be rejected")
+	}
+}
+
+func TestOutboxCompactionDropsAcknowledgedSegments(t *testing.T) {
+	dir := t.TempDir()
+	// Tiny segments so every batch starts a new one
+	outbox, _ := OpenOutbox(dir, FsyncNever, 1)
+	defer outbox.Close()
+
+	ids := make([]uint64, 3)
+	for i := range ids {
+		ids[i], _ = outbox.Append([]byte("batch"))
+	}
+	outbox.Ack(ids[0])
+	outbox.Ack(ids[2])
+	if err := outbox.Compact(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "segment-*.log"))
+	if len(segments) != 2 {
+		t.Fatalf("expected the first segment to be removed and the second one kept, got %v", segments)
+	}
+}
@@ -0,0 +1,318 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/logger"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// pipelinedBatch A batch of the agency file sent by the pipeline. position
+// is where the rows of the batch end in the agency file
+type pipelinedBatch struct {
+	batch    Batch
+	outboxID uint64
+	position ReaderPosition
+	acked    bool
+}
+
+// pipelineResponse A message read by the pipeline reader. sent is the
+// sequence number of the batch written in the same position of the stream,
+// used to match responses that do not carry one
+type pipelineResponse struct {
+	sent    uint64
+	message protocol.Message
+}
+
+// queuedBatch A batch waiting to be written by the pipeline writer
+type queuedBatch struct {
+	seq     uint64
+	message protocol.Message
+}
+
+// pipelineError Failure of the writer or the reader of the pipeline
+type pipelineError struct {
+	action string
+	err    error
+}
+
+// pipeline Sends the batches of the agency file on a single connection
+// without waiting for the acknowledgement of a batch before sending the next
+// one. At most window batches are in flight: submitting a batch while the
+// window is full blocks until an acknowledgement frees a slot. A writer
+// goroutine writes the queued batches and tells a reader goroutine how many
+// responses to wait for, and acknowledgements are matched to the batches in
+// flight by their sequence number. If the server closes the connection, the
+// batches in flight are sent again in a new one
+type pipeline struct {
+	client *Client
+	window int
+
+	inflight map[uint64]*pipelinedBatch
+	// order Batches in flight in the order they were sent, used to save the
+	// checkpoint only up to the oldest batch that was not acknowledged
+	order []*pipelinedBatch
+	// failures Consecutive connection failures without an acknowledgement
+	failures int
+	backoff  *Backoff
+
+	running   bool
+	conn      *connection
+	queue     chan queuedBatch
+	responses chan pipelineResponse
+	errs      chan pipelineError
+	wg        sync.WaitGroup
+}
+
+func newPipeline(client *Client, window int) *pipeline {
+	retry := client.config.Retry
+	return &pipeline{
+		client:   client,
+		window:   window,
+		inflight: make(map[uint64]*pipelinedBatch),
+		backoff:  NewBackoff(retry.InitialBackoff, retry.MaxBackoff, retry.Jitter),
+	}
+}
+
+// submit Queues the batch to be sent, blocking while the window is full.
+// position is where the rows of the batch end in the agency file, saved as
+// checkpoint once the batch and every batch before it are acknowledged
+func (p *pipeline) submit(ctx context.Context, batch Batch, position ReaderPosition) error {
+	for len(p.order) >= p.window {
+		log.Debug("pipeline_full", "in_progress",
+			logger.F("client_id", p.client.config.ID),
+			logger.F("window", p.window),
+		)
+		if err := p.await(ctx); err != nil {
+			return err
+		}
+	}
+
+	entry := &pipelinedBatch{batch: batch, position: position}
+	if p.client.outbox != nil {
+		id, err := p.client.outbox.Append(batch.Payload())
+		if err != nil {
+			return err
+		}
+		entry.outboxID = id
+	}
+	if !p.running {
+		if err := p.start(ctx); err != nil {
+			return err
+		}
+	}
+	p.inflight[batch.Seq] = entry
+	p.order = append(p.order, entry)
+	return p.enqueue(batch)
+}
+
+// drain Waits until every batch in flight is acknowledged and stops the
+// writer and the reader, leaving the connection open
+func (p *pipeline) drain(ctx context.Context) error {
+	for len(p.order) > 0 {
+		if err := p.await(ctx); err != nil {
+			return err
+		}
+	}
+	p.stop(false)
+	return nil
+}
+
+// close Stops the writer and the reader. If batches are still in flight the
+// connection is closed too, since their responses will never be read
+func (p *pipeline) close() {
+	p.stop(len(p.order) > 0)
+}
+
+// await Waits for the next response or failure of the pipeline
+func (p *pipeline) await(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		p.stop(true)
+		return ctx.Err()
+	case response := <-p.responses:
+		return p.complete(response)
+	case failure := <-p.errs:
+		return p.recover(ctx, failure)
+	}
+}
+
+// complete Matches the response with the batch in flight it answers and
+// handles it as any other batch response
+func (p *pipeline) complete(response pipelineResponse) error {
+	seq := response.sent
+	kind := response.message.Kind
+	if (kind == protocol.MsgAck || kind == protocol.MsgDuplicateBatch) && len(response.message.Payload) >= batchSeqSize {
+		seq = binary.BigEndian.Uint64(response.message.Payload[:batchSeqSize])
+	}
+	entry, ok := p.inflight[seq]
+	if !ok {
+		return categorize(ErrProtocol, errors.Errorf("%v response for batch %d, which is not in flight", kind, seq))
+	}
+	delete(p.inflight, seq)
+	entry.acked = true
+	p.failures = 0
+	p.backoff.Reset()
+
+	err := p.client.batchAnswered(entry.batch, response.message, nil)
+	if p.client.outbox != nil && (err == nil || errors.Is(err, ErrServerRejectedBatch)) {
+		if ackErr := p.client.outbox.Ack(entry.outboxID); ackErr != nil && err == nil {
+			err = ackErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return p.advance()
+}
+
+// advance Removes the acknowledged batches at the head of the order and saves
+// the checkpoint after the last of them
+func (p *pipeline) advance() error {
+	var last *pipelinedBatch
+	for len(p.order) > 0 && p.order[0].acked {
+		last = p.order[0]
+		p.order = p.order[1:]
+	}
+	if last == nil {
+		return nil
+	}
+	return p.client.saveCheckpoint(last.position, last.batch.Seq+1)
+}
+
+// recover Handles a failure of the writer or the reader. If the server
+// closed the connection the batches in flight are sent again in a new one,
+// waiting with exponential backoff while the connection keeps failing
+// without any acknowledgement, up to the retry policy attempts. Otherwise
+// the error is returned
+func (p *pipeline) recover(ctx context.Context, failure pipelineError) error {
+	p.stop(true)
+	// Responses read before the failure are still valid
+	for len(p.responses) > 0 {
+		if err := p.complete(<-p.responses); err != nil {
+			return err
+		}
+	}
+
+	err := p.client.networkError(ctx, failure.action, failure.err)
+	maxAttempts := p.client.config.Retry.MaxAttempts
+	if ctx.Err() != nil || !isConnectionClosed(err) || (maxAttempts > 0 && p.failures >= maxAttempts) {
+		return err
+	}
+	p.failures++
+	p.client.report.Retries++
+	delay := time.Duration(0)
+	if p.failures > 1 {
+		delay = p.backoff.Next()
+	}
+	log.Info("reconnect", "in_progress",
+		logger.F("client_id", p.client.config.ID),
+		logger.F("in_flight", len(p.inflight)),
+		logger.F("retry_in", delay),
+		logger.F("error", err),
+	)
+	if err := sleepContext(ctx, delay); err != nil {
+		return err
+	}
+
+	if err := p.start(ctx); err != nil {
+		return err
+	}
+	for _, entry := range p.order {
+		if !entry.acked {
+			if err := p.enqueue(entry.batch); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// enqueue Hands the batch to the writer. The message is built and signed
+// here, since whether it is compressed depends on the current connection
+// and every send needs a fresh signature
+func (p *pipeline) enqueue(batch Batch) error {
+	message, err := p.client.seal(p.client.batchMessage(batch))
+	if err != nil {
+		return err
+	}
+	p.queue <- queuedBatch{seq: batch.Seq, message: message}
+	return nil
+}
+
+// start Launches the writer and the reader on the client connection,
+// opening a new one if there is none
+func (p *pipeline) start(ctx context.Context) error {
+	if p.client.conn == nil {
+		if err := p.client.createClientSocket(ctx); err != nil {
+			return err
+		}
+	}
+	p.conn = p.client.conn
+	p.queue = make(chan queuedBatch, p.window)
+	p.responses = make(chan pipelineResponse, p.window)
+	p.errs = make(chan pipelineError, 2)
+	sent := make(chan uint64, p.window)
+	p.running = true
+
+	p.wg.Add(2)
+	go p.write(p.conn, p.queue, sent, p.errs)
+	go p.read(p.conn, sent, p.responses, p.errs)
+	return nil
+}
+
+// stop Stops the writer and the reader, waiting for them to finish. If
+// closeConn is true the connection is closed to unblock them
+func (p *pipeline) stop(closeConn bool) {
+	if !p.running {
+		return
+	}
+	close(p.queue)
+	if closeConn {
+		p.client.closeConnection()
+	}
+	p.wg.Wait()
+	p.running = false
+}
+
+// write Writes every queued batch and passes its sequence number to the
+// reader, so it waits for one more response
+func (p *pipeline) write(conn *connection, queue <-chan queuedBatch, sent chan<- uint64, errs chan<- pipelineError) {
+	defer p.wg.Done()
+	defer close(sent)
+	writeTimeout := p.client.config.WriteTimeout
+
+	for queued := range queue {
+		if writeTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		}
+		if err := p.client.codec.WriteMessage(conn, queued.message); err != nil {
+			errs <- pipelineError{action: "send_message", err: err}
+			return
+		}
+		sent <- queued.seq
+	}
+}
+
+// read Reads one response for every batch written
+func (p *pipeline) read(conn *connection, sent <-chan uint64, responses chan<- pipelineResponse, errs chan<- pipelineError) {
+	defer p.wg.Done()
+	readTimeout := p.client.config.ReadTimeout
+
+	for seq := range sent {
+		if readTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+		message, err := p.client.codec.ReadMessage(conn)
+		if err != nil {
+			errs <- pipelineError{action: "receive_message", err: err}
+			return
+		}
+		responses <- pipelineResponse{sent: seq, message: message}
+	}
+}
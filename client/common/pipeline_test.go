@@ -0,0 +1,177 @@
+package common
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// newScriptedServer Accepts connections one at a time and hands each of
+// them, with its index, to script once the hello is answered, closing it
+// once script returns
+func newScriptedServer(t *testing.T, script func(t *testing.T, conn net.Conn, index int)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for index := 0; ; index++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			codec := protocol.NewCodec(0)
+			if hello, err := codec.ReadMessage(conn); err == nil {
+				codec.WriteMessage(conn, acceptHello(hello))
+				script(t, conn, index)
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// readBatches Reads amount batch messages from the connection
+func readBatches(t *testing.T, conn net.Conn, amount int) []Batch {
+	codec := protocol.NewCodec(0)
+	batches := make([]Batch, 0, amount)
+	for i := 0; i < amount; i++ {
+		message, err := codec.ReadMessage(conn)
+		if err != nil {
+			t.Errorf("could not read batch %d: %v", i, err)
+			return batches
+		}
+		batch, err := DecodeBatch(message.Payload)
+		if err != nil {
+			t.Errorf("could not decode batch %d: %v", i, err)
+			return batches
+		}
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func answerBatch(conn net.Conn, kind protocol.MessageKind, batch Batch) {
+	protocol.NewCodec(0).WriteMessage(conn, ackWith(kind, protocol.NewMessage(protocol.MsgBatchBet, batch.Payload())))
+}
+
+func submitBatches(t *testing.T, p *pipeline, amount int) {
+	builder := NewBatchBuilder(1, 1, 1, DefaultBatchMaxBytes)
+	for i := 0; i < amount; i++ {
+		builder.Add(newTestBet())
+		if err := p.submit(context.Background(), builder.Flush(), ReaderPosition{}); err != nil {
+			t.Fatalf("could not submit batch %d: %v", i, err)
+		}
+	}
+}
+
+func TestPipelineMatchesAcksBySeq(t *testing.T) {
+	address := newScriptedServer(t, func(t *testing.T, conn net.Conn, _ int) {
+		batches := readBatches(t, conn, 3)
+		for i := len(batches) - 1; i >= 0; i-- {
+			answerBatch(conn, protocol.MsgAck, batches[i])
+		}
+	})
+	client := newTestClient(t, address)
+	defer client.Close()
+	p := newPipeline(client, 3)
+	defer p.close()
+
+	submitBatches(t, p, 3)
+	if err := p.drain(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.report.BatchesAcknowledged != 3 {
+		t.Fatalf("expected 3 acknowledged batches, got %+v", client.report)
+	}
+}
+
+func TestPipelineBlocksWhileWindowIsFull(t *testing.T) {
+	address := newScriptedServer(t, func(t *testing.T, conn net.Conn, _ int) {
+		batches := readBatches(t, conn, 2)
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := protocol.NewCodec(0).ReadMessage(conn); err == nil {
+			t.Error("a batch was sent while the window was full")
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		for _, batch := range batches {
+			answerBatch(conn, protocol.MsgAck, batch)
+		}
+		for _, batch := range readBatches(t, conn, 1) {
+			answerBatch(conn, protocol.MsgAck, batch)
+		}
+	})
+	client := newTestClient(t, address)
+	defer client.Close()
+	p := newPipeline(client, 2)
+	defer p.close()
+
+	submitBatches(t, p, 3)
+	if err := p.drain(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if client.report.BatchesAcknowledged != 3 {
+		t.Fatalf("expected 3 acknowledged batches, got %+v", client.report)
+	}
+}
+
+func TestPipelineResendsBatchesInFlightAfterReconnect(t *testing.T) {
+	resent := make(chan []Batch, 1)
+	address := newScriptedServer(t, func(t *testing.T, conn net.Conn, index int) {
+		batches := readBatches(t, conn, 2)
+		if index == 0 {
+			// The first batch is stored but the connection is lost before
+			// acknowledging anything
+			return
+		}
+		resent <- batches
+		answerBatch(conn, protocol.MsgDuplicateBatch, batches[0])
+		answerBatch(conn, protocol.MsgAck, batches[1])
+	})
+	client := newTestClient(t, address)
+	defer client.Close()
+	p := newPipeline(client, 2)
+	defer p.close()
+
+	submitBatches(t, p, 2)
+	if err := p.drain(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	batches := <-resent
+	if batches[0].Seq != 1 || batches[1].Seq != 2 {
+		t.Fatalf("expected batches 1 and 2 to be sent again, got %d and %d", batches[0].Seq, batches[1].Seq)
+	}
+	if client.report.Retries != 1 || client.report.BatchesDuplicated != 1 || client.report.BatchesAcknowledged != 2 {
+		t.Fatalf("unexpected report %+v", client.report)
+	}
+}
+
+func TestPipelinedBetsFileDoesNotWaitLoopPeriod(t *testing.T) {
+	server := newFakeServer(t, ackEverything)
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	client.config.BetsFile = writeAgencyFile(t, strings.Repeat("Santiago Lionel,Lorca,30904465,1999-03-17,2201\n", 10))
+	client.config.BatchMaxAmount = 1
+	client.config.BatchWindow = 4
+	client.config.LoopPeriod = time.Second
+
+	start := time.Now()
+	if err := client.sendBetsFile(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= client.config.LoopPeriod {
+		t.Fatalf("expected 10 pipelined batches to take less than the loop period, took %v", elapsed)
+	}
+	if client.report.BatchesAcknowledged != 10 {
+		t.Fatalf("expected 10 batches to be acknowledged, got %+v", client.report)
+	}
+}
@@ -0,0 +1,91 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/logger"
+)
+
+// InvalidBetPolicy Decides what happens with bets that fail validation
+type InvalidBetPolicy string
+
+// Supported policies for invalid bets
+const (
+	// InvalidBetSkip Invalid bets are logged and dropped
+	InvalidBetSkip InvalidBetPolicy = "skip"
+	// InvalidBetQuarantine Invalid bets are dropped and written to a quarantine file
+	InvalidBetQuarantine InvalidBetPolicy = "quarantine"
+	// InvalidBetAbort The first invalid bet stops the client
+	InvalidBetAbort InvalidBetPolicy = "abort"
+)
+
+// ParseInvalidBetPolicy Parses the policy received as a string. An error is
+// returned if the policy is not supported
+func ParseInvalidBetPolicy(policy string) (InvalidBetPolicy, error) {
+	switch p := InvalidBetPolicy(policy); p {
+	case InvalidBetSkip, InvalidBetQuarantine, InvalidBetAbort:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown invalid bet policy %q, expected one of skip, quarantine or abort", policy)
+	}
+}
+
+// InvalidBetHandler Applies an InvalidBetPolicy to the bets that fail validation
+type InvalidBetHandler struct {
+	clientID   string
+	policy     InvalidBetPolicy
+	quarantine *rowsFile
+}
+
+// NewInvalidBetHandler Initializes a handler for the policy received as
+// parameter. The quarantine file is only created when the first bet is
+// quarantined
+func NewInvalidBetHandler(clientID string, policy InvalidBetPolicy, quarantinePath string) *InvalidBetHandler {
+	return &InvalidBetHandler{
+		clientID:   clientID,
+		policy:     policy,
+		quarantine: newRowsFile(quarantinePath),
+	}
+}
+
+// Handle Applies the policy to a bet that failed validation with err. line is
+// the position of the bet in its source. A nil return means the bet was
+// discarded and processing can go on, otherwise the client must stop
+func (h *InvalidBetHandler) Handle(bet Bet, line int, err error) error {
+	return h.HandleRecord(bet.Record(), line, err)
+}
+
+// HandleRecord Same as Handle, for rows of an agency file that could not
+// even be parsed as a bet
+func (h *InvalidBetHandler) HandleRecord(record []string, line int, err error) error {
+	log.Warning("validate_bet", "fail",
+		logger.F("client_id", h.clientID),
+		logger.F("line", line),
+		logger.F("policy", h.policy),
+		logger.F("error", redactor.RedactError(err)),
+	)
+
+	switch h.policy {
+	case InvalidBetAbort:
+		return categorize(ErrInvalidBets, errors.Wrapf(err, "line %d", line))
+	case InvalidBetQuarantine:
+		return h.quarantine.Write(record, err.Error())
+	default:
+		return nil
+	}
+}
+
+// Close Closes the quarantine file if it was opened
+func (h *InvalidBetHandler) Close() error {
+	if !h.quarantine.Opened() {
+		return nil
+	}
+	if err := h.quarantine.Close(); err != nil {
+		log.Error("close_quarantine_file", "fail", logger.F("client_id", h.clientID), logger.F("error", err))
+		return err
+	}
+	log.Info("close_quarantine_file", "success", logger.F("client_id", h.clientID))
+	return nil
+}
@@ -0,0 +1,180 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// betRecordFields Amount of columns of every row of an agency file:
+// first_name, last_name, document, birthdate and number
+const betRecordFields = 5
+
+// utf8BOM Byte order mark some spreadsheet tools prepend to CSV exports
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// ParseError Returned when a row of an agency file cannot be turned into a
+// bet. Reading can go on with the next row after a ParseError
+type ParseError struct {
+	Line   int
+	Record []string
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// ReaderPosition Position in an agency file right after a row: the offset
+// of the next byte to read and the amount of lines already read
+type ReaderPosition struct {
+	Offset int64 `json:"offset"`
+	Line   int   `json:"line"`
+}
+
+// BetReader Streams the bets of an agency file one row at a time, so memory
+// usage does not depend on the size of the file
+type BetReader struct {
+	file     *os.File
+	buffered *bufio.Reader
+	reader   *csv.Reader
+	agency   int
+
+	// line First line of the last row read
+	line int
+	// lastLine Last line of the last row read, rows may span several lines
+	lastLine int
+	// baseLine Lines skipped by Seek, the csv reader counts from there
+	baseLine int
+	// read Bytes read from the file, some of them may still be buffered
+	read int64
+}
+
+// NewBetReader Opens the agency file located at path. Every bet read is
+// assigned to the agency received as parameter
+func NewBetReader(path string, agency int) (*BetReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open bets file %s", path)
+	}
+
+	r := &BetReader{file: file, agency: agency}
+	r.reset()
+	if prefix, err := r.buffered.Peek(len(utf8BOM)); err == nil && bytes.Equal(prefix, utf8BOM) {
+		r.buffered.Discard(len(utf8BOM))
+	}
+	return r, nil
+}
+
+// reset Starts reading the file from its current offset
+func (r *BetReader) reset() {
+	// The csv reader uses the bufio.Reader as it is instead of wrapping it,
+	// and only consumes whole lines from it. That way the bytes consumed by
+	// the csv reader are the ones read from the file minus the buffered ones
+	r.buffered = bufio.NewReader(&countingReader{reader: r.file, read: &r.read})
+	r.reader = csv.NewReader(r.buffered)
+	r.reader.FieldsPerRecord = betRecordFields
+	r.reader.ReuseRecord = true
+}
+
+// Seek Moves the reader to a position previously returned by Position, so
+// the next call to Next returns the row that follows it
+func (r *BetReader) Seek(position ReaderPosition) error {
+	if _, err := r.file.Seek(position.Offset, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "could not seek bets file to offset %d", position.Offset)
+	}
+	r.read = position.Offset
+	r.line = position.Line
+	r.lastLine = position.Line
+	r.baseLine = position.Line
+	r.reset()
+	return nil
+}
+
+// Position Position right after the last row returned by Next
+func (r *BetReader) Position() ReaderPosition {
+	return ReaderPosition{
+		Offset: r.read - int64(r.buffered.Buffered()),
+		Line:   r.lastLine,
+	}
+}
+
+// Next Returns the next bet of the file. io.EOF is returned once every row
+// has been read, and a *ParseError if the current row is malformed
+func (r *BetReader) Next() (Bet, error) {
+	record, err := r.reader.Read()
+	if err == io.EOF {
+		return Bet{}, io.EOF
+	}
+	if err != nil {
+		var csvErr *csv.ParseError
+		if errors.As(err, &csvErr) {
+			r.line = r.baseLine + csvErr.StartLine
+			r.lastLine = r.baseLine + csvErr.Line
+			return Bet{}, &ParseError{Line: r.line, Record: copyRecord(record), Err: csvErr.Err}
+		}
+		return Bet{}, errors.Wrapf(err, "could not read bets file after line %d", r.lastLine)
+	}
+	firstLine, _ := r.reader.FieldPos(0)
+	lastLine, _ := r.reader.FieldPos(len(record) - 1)
+	r.line = r.baseLine + firstLine
+	r.lastLine = r.baseLine + lastLine
+
+	number, err := strconv.Atoi(record[4])
+	if err != nil {
+		return Bet{}, &ParseError{
+			Line:   r.line,
+			Record: copyRecord(record),
+			Err:    fmt.Errorf("number must be numeric, got %q", record[4]),
+		}
+	}
+
+	return Bet{
+		Agency:    r.agency,
+		FirstName: record[0],
+		LastName:  record[1],
+		Document:  record[2],
+		Birthdate: record[3],
+		Number:    number,
+	}, nil
+}
+
+// Line Line of the file where the last bet returned by Next starts
+func (r *BetReader) Line() int {
+	return r.line
+}
+
+// Close Closes the underlying file
+func (r *BetReader) Close() error {
+	return r.file.Close()
+}
+
+// countingReader Keeps track of the amount of bytes read from a reader
+type countingReader struct {
+	reader io.Reader
+	read   *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	*c.read += int64(n)
+	return n, err
+}
+
+// copyRecord Copies the record, since the csv reader reuses its backing array
+func copyRecord(record []string) []string {
+	if record == nil {
+		return nil
+	}
+	return append([]string(nil), record...)
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func writeAgencyFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "agency-1.csv")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("could not write agency file: %v", err)
+	}
+	return path
+}
+
+func TestBetReaderHandlesBOMQuotesAndCRLF(t *testing.T) {
+	path := writeAgencyFile(t, "\xEF\xBB\xBFSantiago Lionel,Lorca,30904465,1999-03-17,2201\r\n"+
+		"\"Lorca, Tiago\",\"Nicolás \"\"Tito\"\"\",34407251,2001-08-29,1033\r\n")
+
+	reader, err := NewBetReader(path, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer reader.Close()
+
+	first, err := reader.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first != newTestBet() {
+		t.Fatalf("expected %+v, got %+v", newTestBet(), first)
+	}
+
+	second, err := reader.Next()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if second.FirstName != "Lorca, Tiago" || second.LastName != `Nicolás "Tito"` || reader.Line() != 2 {
+		t.Fatalf("unexpected bet %+v at line %d", second, reader.Line())
+	}
+
+	if _, err := reader.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestBetReaderReportsLineOfMalformedRows(t *testing.T) {
+	path := writeAgencyFile(t, "Santiago Lionel,Lorca,30904465,1999-03-17,2201\n"+
+		"Agustin Emanuel,Zambrano,21689196\n"+
+		"Tiago Nicolás,Rivera,34407251,2001-08-29,mil\n"+
+		"Nicolas Andres,Huarte,29369913,1989-12-05,6857\n")
+
+	reader, err := NewBetReader(path, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer reader.Close()
+
+	if _, err := reader.Next(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, expectedLine := range []int{2, 3} {
+		_, err := reader.Next()
+		var parseErr *ParseError
+		if !errors.As(err, &parseErr) {
+			t.Fatalf("expected *ParseError, got %v", err)
+		}
+		if parseErr.Line != expectedLine {
+			t.Fatalf("expected error at line %d, got %d", expectedLine, parseErr.Line)
+		}
+	}
+	bet, err := reader.Next()
+	if err != nil || bet.Document != "29369913" {
+		t.Fatalf("expected reading to continue after malformed rows, got %+v, %v", bet, err)
+	}
+}
+
+func TestBetReaderSeekResumesAfterPosition(t *testing.T) {
+	path := writeAgencyFile(t, "\xEF\xBB\xBFSantiago Lionel,Lorca,30904465,1999-03-17,2201\r\n"+
+		"\"Agustin\nEmanuel\",Zambrano,21689196,2000-05-10,9325\r\n"+
+		"Tiago Nicolás,Rivera,34407251,2001-08-29,1033\r\n")
+
+	reader, err := NewBetReader(path, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reader.Next()
+	reader.Next()
+	position := reader.Position()
+	reader.Close()
+
+	if position.Line != 3 {
+		t.Fatalf("expected 3 lines to be read, got %d", position.Line)
+	}
+
+	resumed, err := NewBetReader(path, 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resumed.Close()
+	if err := resumed.Seek(position); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bet, err := resumed.Next()
+	if err != nil || bet.Document != "34407251" || resumed.Line() != 4 {
+		t.Fatalf("expected the third bet at line 4, got %+v at line %d (%v)", bet, resumed.Line(), err)
+	}
+}
@@ -0,0 +1,109 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RedactMode Decides how personal data of the bettors shows in logs
+type RedactMode string
+
+// Supported redaction modes
+const (
+	// RedactNone Personal data is logged as it is
+	RedactNone RedactMode = "none"
+	// RedactMask Only the first and last quarter of every value is logged
+	RedactMask RedactMode = "mask"
+	// RedactHash A salted hash of every value is logged, so the same value
+	// can be followed across log lines without being disclosed
+	RedactHash RedactMode = "hash"
+)
+
+// redactedHashSize Hex characters of the salted hash logged in hash mode
+const redactedHashSize = 16
+
+// personalFields Bet fields that identify a bettor
+var personalFields = map[string]bool{
+	betFieldName(BetFieldFirstName): true,
+	betFieldName(BetFieldLastName):  true,
+	betFieldName(BetFieldDocument):  true,
+	betFieldName(BetFieldBirthdate): true,
+}
+
+// ParseRedactMode Parses the mode received as a string. An error is
+// returned if the mode is not supported
+func ParseRedactMode(mode string) (RedactMode, error) {
+	switch m := RedactMode(mode); m {
+	case RedactNone, RedactMask, RedactHash:
+		return m, nil
+	default:
+		return "", fmt.Errorf("unknown redact mode %q, expected one of none, mask or hash", mode)
+	}
+}
+
+// Redactor Redacts personal data before it is logged
+type Redactor struct {
+	mode RedactMode
+	salt []byte
+}
+
+// NewRedactor Initializes a redactor for the mode received as parameter.
+// In hash mode an empty salt is replaced by a random one, so hashes can only
+// be compared within the same run
+func NewRedactor(mode RedactMode, salt string) *Redactor {
+	r := &Redactor{mode: mode, salt: []byte(salt)}
+	if mode == RedactHash && salt == "" {
+		r.salt = make([]byte, sha256.Size)
+		rand.Read(r.salt)
+	}
+	return r
+}
+
+// Redact Returns the personal value as it must be logged
+func (r *Redactor) Redact(value string) string {
+	switch r.mode {
+	case RedactMask:
+		runes := []rune(value)
+		shown := len(runes) / 4
+		return string(runes[:shown]) + strings.Repeat("*", len(runes)-2*shown) + string(runes[len(runes)-shown:])
+	case RedactHash:
+		mac := hmac.New(sha256.New, r.salt)
+		mac.Write([]byte(value))
+		return "h:" + hex.EncodeToString(mac.Sum(nil))[:redactedHashSize]
+	default:
+		return value
+	}
+}
+
+// RedactError Returns the message of err with the personal values of the
+// bet validation errors it carries redacted
+func (r *Redactor) RedactError(err error) string {
+	var validationErr *ValidationError
+	if r.mode == RedactNone || !errors.As(err, &validationErr) {
+		return err.Error()
+	}
+	redacted := &ValidationError{Errors: make([]FieldError, len(validationErr.Errors))}
+	for i, fieldErr := range validationErr.Errors {
+		if personalFields[fieldErr.Field] && fieldErr.Value != "" {
+			fieldErr.Value = r.Redact(fieldErr.Value)
+		}
+		redacted.Errors[i] = fieldErr
+	}
+	return strings.Replace(err.Error(), validationErr.Error(), redacted.Error(), 1)
+}
+
+// redactor Redaction applied to personal data in every log statement of
+// the package
+var redactor = NewRedactor(RedactNone, "")
+
+// SetLogRedaction Sets how personal data shows in the logs of the package.
+// Must be called before the client starts
+func SetLogRedaction(r *Redactor) {
+	redactor = r
+}
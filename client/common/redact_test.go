@@ -0,0 +1,73 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/logger"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// captureLogs Sends every log of the test, at any level, to the returned
+// buffer and sets the redactor received as parameter until the test ends
+func captureLogs(t *testing.T, r *Redactor) *bytes.Buffer {
+	var buf bytes.Buffer
+	logger.Configure(logger.NewTextBackend(&buf), logger.Debug)
+	SetLogRedaction(r)
+	t.Cleanup(func() {
+		logger.Configure(logger.NewTextBackend(os.Stdout), logger.Debug)
+		SetLogRedaction(NewRedactor(RedactNone, ""))
+	})
+	return &buf
+}
+
+func TestRedactorModes(t *testing.T) {
+	if redacted := NewRedactor(RedactNone, "").Redact("30904465"); redacted != "30904465" {
+		t.Fatalf("expected the value to be kept, got %q", redacted)
+	}
+	if redacted := NewRedactor(RedactMask, "").Redact("30904465"); redacted != "30****65" {
+		t.Fatalf("expected 30****65, got %q", redacted)
+	}
+
+	hashed := NewRedactor(RedactHash, "salt")
+	if hashed.Redact("30904465") != hashed.Redact("30904465") {
+		t.Fatal("expected the same value to hash the same")
+	}
+	if redacted := hashed.Redact("30904465"); strings.Contains(redacted, "30904465") || redacted == NewRedactor(RedactHash, "other").Redact("30904465") {
+		t.Fatalf("expected a hash that depends on the salt, got %q", redacted)
+	}
+}
+
+func TestLogsDoNotShowRawDocuments(t *testing.T) {
+	for _, mode := range []RedactMode{RedactMask, RedactHash} {
+		buf := captureLogs(t, NewRedactor(mode, "salt"))
+		server := newFakeServer(t, func(message protocol.Message) (protocol.Message, bool) {
+			ack := ackWith(protocol.MsgAck, message)
+			ack.Payload = append(ack.Payload, 0, 1, byte(RejectDuplicateBet))
+			return ack, true
+		})
+		client := newTestClient(t, server.listener.Addr().String())
+		if err := client.Send(context.Background(), newTestBet(), newTestBet()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		client.Close()
+
+		invalid := newTestBet()
+		invalid.Birthdate = "2999-01-01"
+		handler := NewInvalidBetHandler("1", InvalidBetSkip, "")
+		handler.Handle(invalid, 1, invalid.Validate())
+
+		output := buf.String()
+		if !strings.Contains(output, "apuesta_recibida") || !strings.Contains(output, "validate_bet") {
+			t.Fatalf("expected the bets to be logged, got %q", output)
+		}
+		for _, raw := range []string{"30904465", "2999-01-01"} {
+			if strings.Contains(output, raw) {
+				t.Fatalf("%s mode logged %s: %q", mode, raw, output)
+			}
+		}
+	}
+}
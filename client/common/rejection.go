@@ -0,0 +1,89 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RejectionReason Code sent by the server explaining why it did not store a
+// bet of an acknowledged batch
+type RejectionReason byte
+
+// Reasons why the server may reject a single bet
+const (
+	RejectInvalidDocument RejectionReason = iota + 1
+	RejectInvalidNumber
+	RejectInvalidName
+	RejectInvalidBirthdate
+	RejectDuplicateBet
+	RejectDrawClosed
+)
+
+func (r RejectionReason) String() string {
+	switch r {
+	case RejectInvalidDocument:
+		return "invalid_document"
+	case RejectInvalidNumber:
+		return "invalid_number"
+	case RejectInvalidName:
+		return "invalid_name"
+	case RejectInvalidBirthdate:
+		return "invalid_birthdate"
+	case RejectDuplicateBet:
+		return "duplicate_bet"
+	case RejectDrawClosed:
+		return "draw_closed"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(r))
+	}
+}
+
+// rejectionSize Size in bytes of every rejection of a batch ack: the index
+// of the bet in the batch (2 bytes) and the reason code (1 byte)
+const rejectionSize = 3
+
+// BetRejection A bet of a batch that the server did not store
+type BetRejection struct {
+	Index  int
+	Reason RejectionReason
+}
+
+// decodeBatchAck Decodes the payload of the answer to a batch: its sequence
+// number optionally followed by the bets that were rejected, each of them
+// at most once
+func decodeBatchAck(payload []byte, batch Batch) (uint64, []BetRejection, error) {
+	if len(payload) < batchSeqSize || (len(payload)-batchSeqSize)%rejectionSize != 0 {
+		return 0, nil, errors.Errorf("batch ack of %d bytes is not a sequence number followed by rejections", len(payload))
+	}
+	seq := binary.BigEndian.Uint64(payload[:batchSeqSize])
+
+	var rejections []BetRejection
+	rejected := make([]bool, batch.Len())
+	for offset := batchSeqSize; offset < len(payload); offset += rejectionSize {
+		rejection := BetRejection{
+			Index:  int(binary.BigEndian.Uint16(payload[offset : offset+2])),
+			Reason: RejectionReason(payload[offset+2]),
+		}
+		if rejection.Index >= batch.Len() {
+			return 0, nil, errors.Errorf("rejected bet %d is out of a batch of %d bets", rejection.Index, batch.Len())
+		}
+		if rejected[rejection.Index] {
+			return 0, nil, errors.Errorf("bet %d is rejected more than once", rejection.Index)
+		}
+		rejected[rejection.Index] = true
+		rejections = append(rejections, rejection)
+	}
+	return seq, rejections, nil
+}
+
+// RejectedBetsPath Returns the path of the file where the bets of an agency
+// file rejected by the server are written: next to it, with a .rejected
+// suffix before the extension
+func RejectedBetsPath(betsFile string) string {
+	extension := filepath.Ext(betsFile)
+	return strings.TrimSuffix(betsFile, extension) + ".rejected" + extension
+}
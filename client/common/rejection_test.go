@@ -0,0 +1,63 @@
+package common
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDecodeBatchAckWithRejections(t *testing.T) {
+	batch := Batch{Seq: 4, Bets: []Bet{newTestBet(), newTestBet(), newTestBet()}}
+	payload := make([]byte, batchSeqSize, batchSeqSize+2*rejectionSize)
+	binary.BigEndian.PutUint64(payload, 4)
+	payload = append(payload, 0, 0, byte(RejectInvalidDocument), 0, 2, byte(RejectDuplicateBet))
+
+	seq, rejections, err := decodeBatchAck(payload, batch)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []BetRejection{{Index: 0, Reason: RejectInvalidDocument}, {Index: 2, Reason: RejectDuplicateBet}}
+	if seq != 4 || len(rejections) != len(expected) {
+		t.Fatalf("unexpected ack of batch %d with rejections %v", seq, rejections)
+	}
+	for i := range expected {
+		if rejections[i] != expected[i] {
+			t.Fatalf("expected rejection %v, got %v", expected[i], rejections[i])
+		}
+	}
+}
+
+func TestDecodeBatchAckRejectsIndexOutOfBatch(t *testing.T) {
+	batch := Batch{Seq: 1, Bets: []Bet{newTestBet()}}
+	payload := make([]byte, batchSeqSize)
+	binary.BigEndian.PutUint64(payload, 1)
+
+	if _, _, err := decodeBatchAck(append(payload, 0, 1, byte(RejectInvalidName)), batch); err == nil {
+		t.Fatal("expected an error for a rejection out of the batch")
+	}
+	if _, _, err := decodeBatchAck(append(payload, 0), batch); err == nil {
+		t.Fatal("expected an error for a truncated rejection")
+	}
+}
+
+func TestDecodeBatchAckRejectsRepeatedIndex(t *testing.T) {
+	batch := Batch{Seq: 1, Bets: []Bet{newTestBet(), newTestBet()}}
+	payload := make([]byte, batchSeqSize)
+	binary.BigEndian.PutUint64(payload, 1)
+	payload = append(payload, 0, 1, byte(RejectInvalidName), 0, 1, byte(RejectDuplicateBet))
+
+	if _, _, err := decodeBatchAck(payload, batch); err == nil {
+		t.Fatal("expected an error for a bet rejected twice")
+	}
+}
+
+func TestRejectedBetsPath(t *testing.T) {
+	cases := map[string]string{
+		"/data/agency-1.csv": "/data/agency-1.rejected.csv",
+		"bets":               "bets.rejected",
+	}
+	for betsFile, expected := range cases {
+		if path := RejectedBetsPath(betsFile); path != expected {
+			t.Fatalf("expected %s for %s, got %s", expected, betsFile, path)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/logger"
+)
+
+// RunReport Summary of what the client did during a run
+type RunReport struct {
+	BetsRead int
+	BetsSent int
+	// BetsRejected Bets of acknowledged batches the server did not store
+	BetsRejected        int
+	BatchesAcknowledged int
+	BatchesRejected     int
+	// BatchesDuplicated Acknowledged batches the server had already stored
+	BatchesDuplicated int
+	Retries           int
+	// BytesBeforeCompression and BytesAfterCompression Size of the payloads
+	// of the batches sent compressed, before and after compressing them
+	BytesBeforeCompression int64
+	BytesAfterCompression  int64
+	WinnersFound           int
+	Duration               time.Duration
+}
+
+// log Prints the report in the format used by every other log line
+func (r RunReport) log(clientID string, err error) {
+	result := "success"
+	if err != nil {
+		result = "fail"
+	}
+	log.Info("run_report", result,
+		logger.F("client_id", clientID),
+		logger.F("bets_read", r.BetsRead),
+		logger.F("bets_sent", r.BetsSent),
+		logger.F("bets_rejected", r.BetsRejected),
+		logger.F("batches_acknowledged", r.BatchesAcknowledged),
+		logger.F("batches_rejected", r.BatchesRejected),
+		logger.F("batches_duplicated", r.BatchesDuplicated),
+		logger.F("retries", r.Retries),
+		logger.Ff("compression_ratio", "%.2f", r.CompressionRatio()),
+		logger.F("winners", r.WinnersFound),
+		logger.F("duration", r.Duration),
+	)
+}
+
+// CompressionRatio Ratio between the size of the batches sent compressed
+// before and after compressing them. 1 if none was compressed
+func (r RunReport) CompressionRatio() float64 {
+	if r.BytesAfterCompression == 0 {
+		return 1
+	}
+	return float64(r.BytesBeforeCompression) / float64(r.BytesAfterCompression)
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"encoding/csv"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// rowsFile CSV file to which rows with the columns of the agency files are
+// appended. The file is only created when the first row is written
+type rowsFile struct {
+	path   string
+	file   *os.File
+	writer *csv.Writer
+}
+
+func newRowsFile(path string) *rowsFile {
+	return &rowsFile{path: path}
+}
+
+// Write Appends the record followed by the reason why it was set apart
+func (r *rowsFile) Write(record []string, reason string) error {
+	if r.writer == nil {
+		file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return errors.Wrapf(err, "could not open %s", r.path)
+		}
+		r.file = file
+		r.writer = csv.NewWriter(file)
+	}
+
+	row := append(append([]string(nil), record...), reason)
+	if err := r.writer.Write(row); err != nil {
+		return errors.Wrapf(err, "could not write %s", r.path)
+	}
+	r.writer.Flush()
+	return errors.Wrapf(r.writer.Error(), "could not write %s", r.path)
+}
+
+// Opened Returns true if the file was created by a write and not closed yet
+func (r *rowsFile) Opened() bool {
+	return r.file != nil
+}
+
+// Close Closes the file if it was opened
+func (r *rowsFile) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	r.writer.Flush()
+	err := r.file.Close()
+	r.file = nil
+	r.writer = nil
+	return err
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// SendSeqBase Sequence number of the first batch built by Send. Batches of
+// the agency file are numbered from 1, so a batch built by Send never takes
+// the sequence number of a batch of the file. Batches split from a larger
+// one are numbered like the ones built by Send
+const SendSeqBase uint64 = 1 << 63
+
+// SeqStore Persists, for every agency, the sequence number of the next
+// batch built by Send, so the batches sent by a later process of the same
+// agency are not taken by the server as duplicates of earlier ones. Processes
+// of the same agency must not send at the same time
+type SeqStore struct {
+	path string
+}
+
+// NewSeqStore Initializes a store that keeps sequence numbers in the file
+// received as parameter, which is created on the first save
+func NewSeqStore(path string) *SeqStore {
+	return &SeqStore{path: path}
+}
+
+// Next Returns the sequence number of the next batch of the agency, or
+// SendSeqBase if none was saved
+func (s *SeqStore) Next(agency int) (uint64, error) {
+	sequences, err := s.load()
+	if err != nil {
+		return 0, err
+	}
+	if next, ok := sequences[strconv.Itoa(agency)]; ok && next > SendSeqBase {
+		return next, nil
+	}
+	return SendSeqBase, nil
+}
+
+// Save Records that next is the sequence number of the next batch of the
+// agency. A lower number than the stored one is ignored, so sequence numbers
+// never go back. The file is written to a temporary file that then replaces
+// the previous one, so a crash never leaves it partially written
+func (s *SeqStore) Save(agency int, next uint64) error {
+	sequences, err := s.load()
+	if err != nil {
+		return err
+	}
+	key := strconv.Itoa(agency)
+	if next <= sequences[key] {
+		return nil
+	}
+	sequences[key] = next
+
+	data, err := json.Marshal(sequences)
+	if err != nil {
+		return errors.Wrap(err, "could not encode batch sequences")
+	}
+	tmp := s.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return errors.Wrapf(err, "could not create batch sequences %s", tmp)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "could not write batch sequences %s", tmp)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errors.Wrapf(err, "could not sync batch sequences %s", tmp)
+	}
+	if err := file.Close(); err != nil {
+		return errors.Wrapf(err, "could not close batch sequences %s", tmp)
+	}
+	return errors.Wrapf(os.Rename(tmp, s.path), "could not replace batch sequences %s", s.path)
+}
+
+// load Reads the stored sequence numbers by agency. An empty map is
+// returned if there are none
+func (s *SeqStore) load() (map[string]uint64, error) {
+	sequences := make(map[string]uint64)
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return sequences, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read batch sequences %s", s.path)
+	}
+	if err := json.Unmarshal(data, &sequences); err != nil {
+		return nil, errors.Wrapf(err, "could not decode batch sequences %s", s.path)
+	}
+	return sequences, nil
+}
@@ -0,0 +1,69 @@
+package common
+
+import "time"
+
+// DefaultBatchTargetLatency Default acknowledgement latency under which
+// adaptive batches keep growing
+const DefaultBatchTargetLatency = 500 * time.Millisecond
+
+// Reasons why the size of adaptive batches changes
+const (
+	resizeLatencyBelowTarget = "latency_below_target"
+	resizeLatencyAboveTarget = "latency_above_target"
+	resizeBatchTooLarge      = "batch_too_large"
+)
+
+// BatchSizer Adapts the maximum amount of bets per batch to how the server
+// handles them. The amount grows by a quarter while batches are acknowledged
+// within the target latency, and is halved when an acknowledgement takes
+// longer or the server rejects a batch for being too large. It only grows
+// after batches that were closed by the amount of bets, so it never goes far
+// beyond what fits in the byte budget of a batch
+type BatchSizer struct {
+	amount int
+	target time.Duration
+}
+
+// NewBatchSizer Initializes a sizer that starts with batches of amount bets
+func NewBatchSizer(amount int, target time.Duration) *BatchSizer {
+	if amount <= 0 {
+		amount = 1
+	}
+	return &BatchSizer{amount: amount, target: target}
+}
+
+// Amount Current maximum amount of bets per batch
+func (s *BatchSizer) Amount() int {
+	return s.amount
+}
+
+// Observe Adapts the amount to the latency of the acknowledgement of a batch
+// of size bets. The reason of the change is returned, or an empty string if
+// the amount did not change
+func (s *BatchSizer) Observe(size int, latency time.Duration) string {
+	if latency > s.target {
+		if s.Shrink() {
+			return resizeLatencyAboveTarget
+		}
+		return ""
+	}
+	if size < s.amount {
+		return ""
+	}
+	step := s.amount / 4
+	if step < 1 {
+		step = 1
+	}
+	s.amount += step
+	return resizeLatencyBelowTarget
+}
+
+// Shrink Halves the amount. false is returned if batches already hold a
+// single bet
+func (s *BatchSizer) Shrink() bool {
+	if s.amount <= 1 {
+		return false
+	}
+	s.amount /= 2
+	return true
+}
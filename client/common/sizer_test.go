@@ -0,0 +1,32 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBatchSizerGrowsWhileUnderTarget(t *testing.T) {
+	sizer := NewBatchSizer(8, 100*time.Millisecond)
+
+	if reason := sizer.Observe(8, 10*time.Millisecond); reason != resizeLatencyBelowTarget || sizer.Amount() != 10 {
+		t.Fatalf("expected the amount to grow to 10, got %d (%q)", sizer.Amount(), reason)
+	}
+	// A batch closed by the byte budget does not make it grow
+	if reason := sizer.Observe(6, 10*time.Millisecond); reason != "" || sizer.Amount() != 10 {
+		t.Fatalf("expected the amount to stay at 10, got %d (%q)", sizer.Amount(), reason)
+	}
+}
+
+func TestBatchSizerShrinksWhenSlow(t *testing.T) {
+	sizer := NewBatchSizer(3, 100*time.Millisecond)
+
+	if reason := sizer.Observe(3, time.Second); reason != resizeLatencyAboveTarget || sizer.Amount() != 1 {
+		t.Fatalf("expected the amount to shrink to 1, got %d (%q)", sizer.Amount(), reason)
+	}
+	if reason := sizer.Observe(1, time.Second); reason != "" || sizer.Amount() != 1 {
+		t.Fatalf("expected the amount to stay at 1, got %d (%q)", sizer.Amount(), reason)
+	}
+	if sizer.Shrink() {
+		t.Fatal("expected batches of a single bet not to shrink")
+	}
+}
@@ -0,0 +1,148 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/logger"
+)
+
+// TLSOptions Files and settings used to build the TLS configuration of the
+// connections with the server. CertFile and KeyFile are only needed for
+// mutual TLS, when the server identifies the agency by its certificate
+type TLSOptions struct {
+	CAFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+	MinVersion string
+}
+
+// tlsVersions TLS versions that can be required as minimum
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion Parses a minimum TLS version such as "1.2". An error is
+// returned if the version is not supported
+func ParseTLSVersion(version string) (uint16, error) {
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, expected 1.2 or 1.3", version)
+}
+
+// tlsVersionName Name of a TLS version used in logs
+func tlsVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return "TLS " + name
+		}
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// NewTLSConfig Builds the TLS configuration described by the options. The
+// server certificate is verified against the CA bundle, or against the
+// system roots if none is given
+func NewTLSConfig(options TLSOptions) (*tls.Config, error) {
+	minVersion := uint16(tls.VersionTLS12)
+	if options.MinVersion != "" {
+		var err error
+		if minVersion, err = ParseTLSVersion(options.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+	config := &tls.Config{
+		ServerName: options.ServerName,
+		MinVersion: minVersion,
+	}
+
+	if options.CAFile != "" {
+		bundle, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read CA bundle")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, errors.Errorf("no certificate found in CA bundle %s", options.CAFile)
+		}
+	}
+
+	if (options.CertFile == "") != (options.KeyFile == "") {
+		return nil, errors.New("client certificate and key must be given together")
+	}
+	if options.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// HandshakeError Returned when the TLS handshake with the server fails for
+// a reason other than the connection being lost, such as a certificate that
+// cannot be verified. Retrying does not help, so it is a configuration error
+type HandshakeError struct {
+	Err error
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("tls handshake failed: %v", e.Err)
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// Is Makes handshake failures match ErrConfig
+func (e *HandshakeError) Is(target error) bool {
+	return target == ErrConfig
+}
+
+// startTLS Starts a TLS session over the connection received as parameter.
+// If the configuration has no server name the host of the address is used
+func (c *Client) startTLS(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	config := c.config.TLS.Clone()
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(c.config.ServerAddress)
+		if err != nil {
+			host = c.config.ServerAddress
+		}
+		config.ServerName = host
+	}
+
+	if c.config.ConnectTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.config.ConnectTimeout))
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		if classified := classifyNetError("tls_handshake", err); classified != err || ctx.Err() != nil {
+			return nil, classified
+		}
+		return nil, &HandshakeError{Err: err}
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	state := tlsConn.ConnectionState()
+	log.Info("tls_handshake", "success",
+		logger.F("client_id", c.config.ID),
+		logger.F("server_name", config.ServerName),
+		logger.F("version", tlsVersionName(state.Version)),
+		logger.F("cipher", tls.CipherSuiteName(state.CipherSuite)),
+		logger.F("client_cert", len(config.Certificates) > 0),
+	)
+	return tlsConn, nil
+}
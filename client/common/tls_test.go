@@ -0,0 +1,187 @@
+package common
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+// testCA Certificate authority generated for a test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate CA key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "central"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue Signs a certificate for name, valid for servers and clients.
+// Returns the certificate and its key in PEM
+func (ca *testCA) issue(t *testing.T, name string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("could not create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func writeTestFile(t *testing.T, dir string, name string, content []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("could not write %s: %v", name, err)
+	}
+	return path
+}
+
+// newTLSFakeServer Same as newFakeServer, serving TLS with a certificate
+// for "central" signed by ca and requiring client certificates signed by it.
+// The common name of every client certificate is sent to agencies
+func newTLSFakeServer(t *testing.T, ca *testCA, handle func(protocol.Message) (protocol.Message, bool), agencies chan<- string) *fakeServer {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, "central")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("could not load server certificate: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) > 0 {
+				agencies <- state.PeerCertificates[0].Subject.CommonName
+			}
+			return nil
+		},
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	return startFakeServer(t, tls.NewListener(listener, config), true, handle)
+}
+
+func TestSendOverMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	agencies := make(chan string, 1)
+	server := newTLSFakeServer(t, ca, ackEverything, agencies)
+	dir := t.TempDir()
+	certPEM, keyPEM := ca.issue(t, "agency-1")
+	config, err := NewTLSConfig(TLSOptions{
+		CAFile:     writeTestFile(t, dir, "ca.pem", ca.pem),
+		CertFile:   writeTestFile(t, dir, "agency.pem", certPEM),
+		KeyFile:    writeTestFile(t, dir, "agency.key", keyPEM),
+		ServerName: "central",
+		MinVersion: "1.3",
+	})
+	if err != nil {
+		t.Fatalf("could not build TLS config: %v", err)
+	}
+
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	client.config.TLS = config
+	if err := client.Send(context.Background(), newTestBet()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if agency := <-agencies; agency != "agency-1" {
+		t.Fatalf("expected the server to identify agency-1, got %q", agency)
+	}
+	state := client.conn.Conn.(*tls.Conn).ConnectionState()
+	if state.Version != tls.VersionTLS13 {
+		t.Fatalf("expected TLS 1.3, got %s", tlsVersionName(state.Version))
+	}
+}
+
+func TestSendFailsWhenServerIsNotTrusted(t *testing.T) {
+	server := newTLSFakeServer(t, newTestCA(t), ackEverything, make(chan string, 1))
+	other := newTestCA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(other.cert)
+
+	client := newTestClient(t, server.listener.Addr().String())
+	defer client.Close()
+	client.config.Retry.MaxAttempts = 5
+	client.config.TLS = &tls.Config{RootCAs: roots, ServerName: "central"}
+
+	err := client.Send(context.Background(), newTestBet())
+	var handshakeErr *HandshakeError
+	if !errors.As(err, &handshakeErr) || !errors.Is(err, ErrConfig) {
+		t.Fatalf("expected a *HandshakeError matching ErrConfig, got %v", err)
+	}
+	if client.report.Retries != 0 {
+		t.Fatalf("expected the handshake not to be retried, got %d retries", client.report.Retries)
+	}
+}
+
+func TestNewTLSConfigRequiresCertificateAndKeyTogether(t *testing.T) {
+	dir := t.TempDir()
+	certPEM, _ := newTestCA(t).issue(t, "agency-1")
+	_, err := NewTLSConfig(TLSOptions{CertFile: writeTestFile(t, dir, "agency.pem", certPEM)})
+	if err == nil {
+		t.Fatal("expected an error for a certificate without key")
+	}
+	if _, err := NewTLSConfig(TLSOptions{MinVersion: "1.0"}); err == nil {
+		t.Fatal("expected an error for an unsupported minimum version")
+	}
+}
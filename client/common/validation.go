@@ -0,0 +1,102 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits enforced when validating a bet
+const (
+	MinBetNumber    = 0
+	MaxBetNumber    = 9999
+	MinDocument     = 1
+	MaxDocument     = 99999999
+	birthdateFormat = "2006-01-02"
+)
+
+// FieldError A single violation found while validating a bet field. Value
+// is the offending value, kept apart from the reason so logs can redact it
+type FieldError struct {
+	Field  string
+	Reason string
+	Value  string
+}
+
+func (e FieldError) Error() string {
+	if e.Value == "" {
+		return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+	}
+	return fmt.Sprintf("%s: %s, got %q", e.Field, e.Reason, e.Value)
+}
+
+// ValidationError Aggregates every violation found in a bet
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	reasons := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		reasons[i] = fieldErr.Error()
+	}
+	return "invalid bet: " + strings.Join(reasons, "; ")
+}
+
+// Validate Checks every field of the bet and returns a *ValidationError
+// listing all the violations found, or nil if the bet is valid
+func (b Bet) Validate() error {
+	var errs []FieldError
+	add := func(tag byte, value string, reason string, args ...interface{}) {
+		errs = append(errs, FieldError{Field: betFieldName(tag), Reason: fmt.Sprintf(reason, args...), Value: value})
+	}
+
+	if b.Agency <= 0 {
+		add(BetFieldAgency, strconv.Itoa(b.Agency), "must be a positive number")
+	}
+
+	validateName := func(tag byte, name string) {
+		if strings.TrimSpace(name) == "" {
+			add(tag, "", "must not be empty")
+		} else if len(name) > MaxBetFieldLength {
+			add(tag, "", "is %d bytes long, maximum is %d", len(name), MaxBetFieldLength)
+		}
+	}
+	validateName(BetFieldFirstName, b.FirstName)
+	validateName(BetFieldLastName, b.LastName)
+
+	if document, err := strconv.Atoi(b.Document); err != nil || !isDigits(b.Document) {
+		add(BetFieldDocument, b.Document, "must be numeric")
+	} else if document < MinDocument || document > MaxDocument {
+		add(BetFieldDocument, b.Document, "must be between %d and %d", MinDocument, MaxDocument)
+	}
+
+	if birthdate, err := time.Parse(birthdateFormat, b.Birthdate); err != nil {
+		add(BetFieldBirthdate, b.Birthdate, "must have format YYYY-MM-DD")
+	} else if birthdate.After(time.Now()) {
+		add(BetFieldBirthdate, b.Birthdate, "must not be in the future")
+	}
+
+	if b.Number < MinBetNumber || b.Number > MaxBetNumber {
+		add(BetFieldNumber, strconv.Itoa(b.Number), "must be between %d and %d", MinBetNumber, MaxBetNumber)
+	}
+
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// isDigits Returns true if s is a non empty string made only of ASCII digits
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// jsonLevels logrus level every level is written with. logrus has no
+// critical nor notice levels
+var jsonLevels = map[Level]logrus.Level{
+	Critical: logrus.FatalLevel,
+	Error:    logrus.ErrorLevel,
+	Warning:  logrus.WarnLevel,
+	Notice:   logrus.InfoLevel,
+	Info:     logrus.InfoLevel,
+	Debug:    logrus.DebugLevel,
+}
+
+// jsonBackend Writes every statement as a JSON object through logrus, with
+// the action, the result and every field as keys of their own
+type jsonBackend struct {
+	logger *logrus.Logger
+}
+
+// NewJSONBackend Initializes a backend that writes statements to w as one
+// JSON object per line
+func NewJSONBackend(w io.Writer) Backend {
+	logger := logrus.New()
+	logger.SetOutput(w)
+	logger.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	// Levels are filtered by the Logger
+	logger.SetLevel(logrus.TraceLevel)
+	return &jsonBackend{logger: logger}
+}
+
+func (b *jsonBackend) Write(entry Entry) {
+	fields := make(logrus.Fields, len(entry.Fields)+2)
+	message := entry.Message
+	if entry.Action != "" {
+		fields["action"] = entry.Action
+		fields["result"] = entry.Result
+		message = entry.Action
+	}
+	for _, field := range entry.Fields {
+		fields[field.Key] = jsonValue(field.Value)
+	}
+	// Log does not exit on fatal entries, unlike Fatal
+	b.logger.WithFields(fields).Log(jsonLevels[entry.Level], message)
+}
+
+// jsonValue Value of a field as encoded in JSON. Values that describe
+// themselves as text, such as durations or message kinds, are written as
+// that text
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case []byte:
+		return string(v)
+	default:
+		return v
+	}
+}
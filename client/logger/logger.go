@@ -0,0 +1,206 @@
+// Package logger Structured logging of the client. Every statement is an
+// action, its result and an ordered list of fields, written by a Backend
+// selected at startup: text lines with the "action: x | result: y" format,
+// or JSON objects where every field is a key of its own
+package logger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Level Severity of a log statement, from the most to the least severe
+type Level int
+
+// Supported levels
+const (
+	Critical Level = iota
+	Error
+	Warning
+	Notice
+	Info
+	Debug
+)
+
+var levelNames = []string{"CRITICAL", "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG"}
+
+func (l Level) String() string {
+	if l < Critical || l > Debug {
+		return fmt.Sprintf("LEVEL(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel Parses a level such as "INFO", ignoring case. An error is
+// returned if the level is not supported
+func ParseLevel(level string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(level, name) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", level)
+}
+
+// Field Key and value of a log statement. format, if set, is used to write
+// the value as text
+type Field struct {
+	Key    string
+	Value  interface{}
+	format string
+}
+
+// F Initializes a field
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Ff Initializes a field whose value is written as text with the format
+// received as parameter, e.g. "%.2f". Structured backends keep the value
+func Ff(key string, format string, value interface{}) Field {
+	return Field{Key: key, Value: value, format: format}
+}
+
+// Text Value of the field as written in text lines
+func (f Field) Text() string {
+	if f.format != "" {
+		return fmt.Sprintf(f.format, f.Value)
+	}
+	if data, ok := f.Value.([]byte); ok {
+		return string(data)
+	}
+	return fmt.Sprint(f.Value)
+}
+
+// Entry A log statement. Statements that are not the result of an action,
+// such as configuration errors, only carry a Message
+type Entry struct {
+	Level   Level
+	Action  string
+	Result  string
+	Fields  []Field
+	Message string
+}
+
+// Text Returns the entry in the "action: x | result: y | key: value" format
+func (e Entry) Text() string {
+	if e.Action == "" {
+		return e.Message
+	}
+	var b strings.Builder
+	b.WriteString("action: ")
+	b.WriteString(e.Action)
+	b.WriteString(" | result: ")
+	b.WriteString(e.Result)
+	for _, field := range e.Fields {
+		b.WriteString(" | ")
+		b.WriteString(field.Key)
+		b.WriteString(": ")
+		b.WriteString(field.Text())
+	}
+	return b.String()
+}
+
+// Backend Writes log statements somewhere
+type Backend interface {
+	Write(entry Entry)
+}
+
+// Logger Hands the statements at or above its level to a backend
+type Logger struct {
+	backend Backend
+	level   Level
+}
+
+// std Logger shared by every package of the client
+var std = &Logger{backend: NewTextBackend(os.Stdout), level: Debug}
+
+// Get Returns the logger shared by every package of the client
+func Get() *Logger {
+	return std
+}
+
+// Configure Sets the backend and the level of the shared logger. Must be
+// called before anything is logged from more than one goroutine
+func Configure(backend Backend, level Level) {
+	std.backend = backend
+	std.level = level
+}
+
+// Enabled Returns true if statements of the level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level <= l.level
+}
+
+func (l *Logger) log(level Level, action string, result string, fields []Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.backend.Write(Entry{Level: level, Action: action, Result: result, Fields: fields})
+}
+
+// Critical Logs the result of an action that stops the client
+func (l *Logger) Critical(action string, result string, fields ...Field) {
+	l.log(Critical, action, result, fields)
+}
+
+// Error Logs the result of an action that failed
+func (l *Logger) Error(action string, result string, fields ...Field) {
+	l.log(Error, action, result, fields)
+}
+
+// Warning Logs the result of an action that failed without stopping the
+// client
+func (l *Logger) Warning(action string, result string, fields ...Field) {
+	l.log(Warning, action, result, fields)
+}
+
+// Info Logs the result of an action
+func (l *Logger) Info(action string, result string, fields ...Field) {
+	l.log(Info, action, result, fields)
+}
+
+// Debug Logs the result of an action, for debugging purposes only
+func (l *Logger) Debug(action string, result string, fields ...Field) {
+	l.log(Debug, action, result, fields)
+}
+
+// Criticalf Logs a message that is not the result of an action and stops
+// the client, such as an invalid configuration
+func (l *Logger) Criticalf(format string, args ...interface{}) {
+	if l.Enabled(Critical) {
+		l.backend.Write(Entry{Level: Critical, Message: fmt.Sprintf(format, args...)})
+	}
+}
+
+// Format Encoding of the log statements
+type Format string
+
+// Supported formats
+const (
+	// FormatText Lines such as "action: x | result: y | key: value"
+	FormatText Format = "text"
+	// FormatJSON One JSON object per statement
+	FormatJSON Format = "json"
+)
+
+// ParseFormat Parses the format received as a string. An error is returned
+// if the format is not supported
+func ParseFormat(format string) (Format, error) {
+	switch f := Format(format); f {
+	case FormatText, FormatJSON:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown log format %q, expected one of text or json", format)
+	}
+}
+
+// NewBackend Initializes the backend of the format received as parameter
+func NewBackend(format Format, w io.Writer) Backend {
+	if format == FormatJSON {
+		return NewJSONBackend(w)
+	}
+	return NewTextBackend(w)
+}
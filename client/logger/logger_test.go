@@ -0,0 +1,75 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextBackendKeepsTheLineFormat(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Logger{backend: NewTextBackend(&buf), level: Debug}
+	l.Info("apuesta_enviada", "success", F("client_id", "1"), F("cantidad", 10))
+	l.Warning("connect", "retry", F("retry_in", 200*time.Millisecond), Ff("ratio", "%.2f", 1.5))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	expected := []*regexp.Regexp{
+		regexp.MustCompile(`^\d{4}-\d\d-\d\d \d\d:\d\d:\d\d INFO     action: apuesta_enviada \| result: success \| client_id: 1 \| cantidad: 10$`),
+		regexp.MustCompile(`^\d{4}-\d\d-\d\d \d\d:\d\d:\d\d WARNI     action: connect \| result: retry \| retry_in: 200ms \| ratio: 1.50$`),
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %q", len(expected), buf.String())
+	}
+	for i, line := range lines {
+		if !expected[i].MatchString(line) {
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+}
+
+func TestJSONBackendWritesFieldsAsKeys(t *testing.T) {
+	var buf bytes.Buffer
+	l := &Logger{backend: NewJSONBackend(&buf), level: Info}
+	l.Debug("checkpoint", "success", F("line", 3))
+	l.Error("apuesta_enviada", "fail", F("cantidad", 10), F("error", errors.New("connection reset")), F("payload", []byte("bad")))
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("expected a single JSON object, got %q: %v", buf.String(), err)
+	}
+	expected := map[string]interface{}{
+		"action":   "apuesta_enviada",
+		"result":   "fail",
+		"level":    "error",
+		"cantidad": float64(10),
+		"error":    "connection reset",
+		"payload":  "bad",
+	}
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Fatalf("expected %s to be %v, got %v", key, value, entry[key])
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Fatalf("expected a timestamp, got %v", entry)
+	}
+}
+
+func TestParseLevelAndFormat(t *testing.T) {
+	if level, err := ParseLevel("debug"); err != nil || level != Debug {
+		t.Fatalf("expected DEBUG, got %v, %v", level, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatal("expected an error for an unknown level")
+	}
+	if format, err := ParseFormat("json"); err != nil || format != FormatJSON {
+		t.Fatalf("expected json, got %v, %v", format, err)
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
@@ -0,0 +1,46 @@
+package logger
+
+import (
+	"io"
+
+	"github.com/op/go-logging"
+)
+
+// textFormat Format of every text line: time, level and the statement
+const textFormat = `%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`
+
+// textBackend Writes every statement as a line of text through go-logging
+type textBackend struct {
+	logger *logging.Logger
+}
+
+// NewTextBackend Initializes a backend that writes statements to w as
+// lines such as "2006-01-02 15:04:05 INFO     action: x | result: y"
+func NewTextBackend(w io.Writer) Backend {
+	formatted := logging.NewBackendFormatter(logging.NewLogBackend(w, "", 0), logging.MustStringFormatter(textFormat))
+	leveled := logging.AddModuleLevel(formatted)
+	// Levels are filtered by the Logger
+	leveled.SetLevel(logging.DEBUG, "")
+
+	logger := logging.MustGetLogger("log")
+	logger.SetBackend(leveled)
+	return &textBackend{logger: logger}
+}
+
+func (b *textBackend) Write(entry Entry) {
+	message := entry.Text()
+	switch entry.Level {
+	case Critical:
+		b.logger.Critical(message)
+	case Error:
+		b.logger.Error(message)
+	case Warning:
+		b.logger.Warning(message)
+	case Notice:
+		b.logger.Notice(message)
+	case Info:
+		b.logger.Info(message)
+	default:
+		b.logger.Debug(message)
+	}
+}
@@ -1,19 +1,44 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
+	"math/rand"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/op/go-logging"
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/auth"
 	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/logger"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
 )
 
-var log = logging.MustGetLogger("log")
+var log = logger.Get()
+
+// buildVersion Version of the client binary sent to the server in the hello
+// of every connection. Set at build time with -ldflags "-X main.buildVersion=..."
+var buildVersion = "dev"
+
+// Exit codes of the client, so the orchestration can tell apart why it failed
+const (
+	exitCodeSuccess       = 0
+	exitCodeUnknown       = 1
+	exitCodeConfig        = 2
+	exitCodeInvalidBets   = 3
+	exitCodeUnavailable   = 4
+	exitCodeTimeout       = 5
+	exitCodeProtocol      = 6
+	exitCodeRejectedBatch = 7
+	exitCodeSignalBase    = 128
+)
 
 // InitConfig Function that uses viper library to parse configuration parameters.
 // Viper is configured to read variables from both environment variables and the
@@ -34,9 +59,75 @@ func InitConfig() (*viper.Viper, error) {
 	// Add env variables supported
 	v.BindEnv("id")
 	v.BindEnv("server", "address")
+	v.BindEnv("server", "connectTimeout")
+	v.BindEnv("server", "readTimeout")
+	v.BindEnv("server", "writeTimeout")
+	v.BindEnv("server", "tls", "enabled")
+	v.BindEnv("server", "tls", "caFile")
+	v.BindEnv("server", "tls", "certFile")
+	v.BindEnv("server", "tls", "keyFile")
+	v.BindEnv("server", "tls", "serverName")
+	v.BindEnv("server", "tls", "minVersion")
+	v.BindEnv("auth", "secretFile")
+	v.BindEnv("connection", "mode")
+	v.BindEnv("retry", "maxAttempts")
+	v.BindEnv("retry", "initialBackoff")
+	v.BindEnv("retry", "maxBackoff")
+	v.BindEnv("retry", "jitter")
 	v.BindEnv("loop", "period")
-	v.BindEnv("loop", "amount")
 	v.BindEnv("log", "level")
+	v.BindEnv("log", "format")
+	v.BindEnv("log", "redact")
+	v.BindEnv("log", "redactSalt")
+	v.BindEnv("protocol", "maxFrameSize")
+	v.BindEnv("bets", "file")
+	v.BindEnv("bets", "invalidPolicy")
+	v.BindEnv("bets", "quarantineFile")
+	v.BindEnv("checkpoint", "file")
+	v.BindEnv("batch", "maxAmount")
+	v.BindEnv("batch", "maxBytes")
+	v.BindEnv("batch", "window")
+	v.BindEnv("batch", "adaptive")
+	v.BindEnv("batch", "targetLatency")
+	v.BindEnv("batch", "seqFile")
+	v.BindEnv("compression", "enabled")
+	v.BindEnv("compression", "threshold")
+	v.BindEnv("outbox", "dir")
+	v.BindEnv("outbox", "fsync")
+	v.BindEnv("outbox", "segmentSize")
+	v.BindEnv("winners", "timeout")
+	v.BindEnv("winners", "initialBackoff")
+	v.BindEnv("winners", "maxBackoff")
+
+	v.SetDefault("server.connectTimeout", "5s")
+	v.SetDefault("server.readTimeout", "30s")
+	v.SetDefault("server.writeTimeout", "10s")
+	v.SetDefault("log.format", string(logger.FormatText))
+	v.SetDefault("log.redact", string(common.RedactNone))
+	v.SetDefault("server.tls.enabled", false)
+	v.SetDefault("server.tls.minVersion", "1.2")
+	v.SetDefault("connection.mode", string(common.ConnectionPersistent))
+	v.SetDefault("retry.maxAttempts", 10)
+	v.SetDefault("retry.initialBackoff", "200ms")
+	v.SetDefault("retry.maxBackoff", "10s")
+	v.SetDefault("retry.jitter", common.DefaultBackoffJitter)
+	v.SetDefault("protocol.maxFrameSize", protocol.DefaultMaxFrameSize)
+	v.SetDefault("bets.invalidPolicy", string(common.InvalidBetSkip))
+	v.SetDefault("bets.quarantineFile", "./quarantine.csv")
+	v.SetDefault("checkpoint.file", "./checkpoint.json")
+	v.SetDefault("batch.maxBytes", common.DefaultBatchMaxBytes)
+	v.SetDefault("batch.window", 1)
+	v.SetDefault("batch.adaptive", false)
+	v.SetDefault("batch.targetLatency", common.DefaultBatchTargetLatency.String())
+	v.SetDefault("batch.seqFile", "./batch-seq.json")
+	v.SetDefault("compression.enabled", false)
+	v.SetDefault("compression.threshold", common.DefaultCompressionThreshold)
+	v.SetDefault("outbox.dir", "./outbox")
+	v.SetDefault("outbox.fsync", string(common.FsyncAlways))
+	v.SetDefault("outbox.segmentSize", common.DefaultOutboxSegmentSize)
+	v.SetDefault("winners.timeout", "5m")
+	v.SetDefault("winners.initialBackoff", "100ms")
+	v.SetDefault("winners.maxBackoff", "5s")
 
 	// Try to read configuration from config file. If config file
 	// does not exists then ReadInConfig will fail but configuration
@@ -47,69 +138,327 @@ func InitConfig() (*viper.Viper, error) {
 		fmt.Printf("Configuration could not be read from config file. Using env variables instead")
 	}
 
+	// The default bets file depends on the client id, which may come from
+	// either source
+	v.SetDefault("bets.file", fmt.Sprintf("./agency-%s.csv", v.GetString("id")))
+
 	// Parse time.Duration variables and return an error if those variables cannot be parsed
 
 	if _, err := time.ParseDuration(v.GetString("loop.period")); err != nil {
 		return nil, errors.Wrapf(err, "Could not parse CLI_LOOP_PERIOD env var as time.Duration.")
 	}
+	if _, err := time.ParseDuration(v.GetString("server.connectTimeout")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_SERVER_CONNECTTIMEOUT env var as time.Duration.")
+	}
+	if _, err := time.ParseDuration(v.GetString("server.readTimeout")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_SERVER_READTIMEOUT env var as time.Duration.")
+	}
+	if _, err := time.ParseDuration(v.GetString("server.writeTimeout")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_SERVER_WRITETIMEOUT env var as time.Duration.")
+	}
+	if _, err := time.ParseDuration(v.GetString("retry.initialBackoff")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_RETRY_INITIALBACKOFF env var as time.Duration.")
+	}
+	if _, err := time.ParseDuration(v.GetString("retry.maxBackoff")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_RETRY_MAXBACKOFF env var as time.Duration.")
+	}
+	if _, err := time.ParseDuration(v.GetString("batch.targetLatency")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_BATCH_TARGETLATENCY env var as time.Duration.")
+	}
+	if _, err := time.ParseDuration(v.GetString("winners.timeout")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_WINNERS_TIMEOUT env var as time.Duration.")
+	}
+	if _, err := time.ParseDuration(v.GetString("winners.initialBackoff")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_WINNERS_INITIALBACKOFF env var as time.Duration.")
+	}
+	if _, err := time.ParseDuration(v.GetString("winners.maxBackoff")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_WINNERS_MAXBACKOFF env var as time.Duration.")
+	}
+
+	if _, err := common.ParseInvalidBetPolicy(v.GetString("bets.invalidPolicy")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_BETS_INVALIDPOLICY env var.")
+	}
+
+	if _, err := common.ParseConnectionMode(v.GetString("connection.mode")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_CONNECTION_MODE env var.")
+	}
+
+	if _, err := logger.ParseFormat(v.GetString("log.format")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_LOG_FORMAT env var.")
+	}
+
+	if _, err := common.ParseRedactMode(v.GetString("log.redact")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_LOG_REDACT env var.")
+	}
+
+	if _, err := common.ParseTLSVersion(v.GetString("server.tls.minVersion")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_SERVER_TLS_MINVERSION env var.")
+	}
+
+	if jitter := v.GetFloat64("retry.jitter"); jitter < 0 || jitter > 1 {
+		return nil, errors.Errorf("CLI_RETRY_JITTER must be between 0 and 1.")
+	}
+
+	if _, err := common.ParseFsyncPolicy(v.GetString("outbox.fsync")); err != nil {
+		return nil, errors.Wrapf(err, "Could not parse CLI_OUTBOX_FSYNC env var.")
+	}
+
+	if v.GetInt("batch.maxAmount") <= 0 {
+		return nil, errors.Errorf("CLI_BATCH_MAXAMOUNT must be a positive number.")
+	}
+	if v.GetInt("batch.maxBytes") > v.GetInt("protocol.maxFrameSize") {
+		return nil, errors.Errorf("CLI_BATCH_MAXBYTES cannot be greater than CLI_PROTOCOL_MAXFRAMESIZE.")
+	}
+	if v.GetInt("batch.window") <= 0 {
+		return nil, errors.Errorf("CLI_BATCH_WINDOW must be a positive number.")
+	}
+	if v.GetInt("compression.threshold") < 0 {
+		return nil, errors.Errorf("CLI_COMPRESSION_THRESHOLD cannot be negative.")
+	}
+	// Batches are only compressed above the threshold, so a batch sized by
+	// its compressed form at or above it would not fit the budget raw
+	if v.GetBool("compression.enabled") && v.GetInt("compression.threshold") >= v.GetInt("batch.maxBytes") {
+		return nil, errors.Errorf("CLI_COMPRESSION_THRESHOLD must be lower than CLI_BATCH_MAXBYTES.")
+	}
 
 	return v, nil
 }
 
-// InitLogger Receives the log level to be set in go-logging as a string. This method
-// parses the string and set the level to the logger. If the level string is not
-// valid an error is returned
-func InitLogger(logLevel string) error {
-	baseBackend := logging.NewLogBackend(os.Stdout, "", 0)
-	format := logging.MustStringFormatter(
-		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
-	)
-	backendFormatter := logging.NewBackendFormatter(baseBackend, format)
-
-	backendLeveled := logging.AddModuleLevel(backendFormatter)
-	logLevelCode, err := logging.LogLevel(logLevel)
+// InitLogger Receives the log level and format as strings. This method
+// parses them and sets the backend and the level of the logger. If the level
+// or the format are not valid an error is returned
+func InitLogger(logLevel string, logFormat string) error {
+	level, err := logger.ParseLevel(logLevel)
 	if err != nil {
 		return err
 	}
-	backendLeveled.SetLevel(logLevelCode, "")
-
-	// Set the backends to be used.
-	logging.SetBackend(backendLeveled)
+	format, err := logger.ParseFormat(logFormat)
+	if err != nil {
+		return err
+	}
+	logger.Configure(logger.NewBackend(format, os.Stdout), level)
 	return nil
 }
 
+// InitTLS Builds the TLS configuration of the connections with the server
+// from the server.tls block. nil is returned if TLS is disabled
+func InitTLS(v *viper.Viper) (*tls.Config, error) {
+	if !v.GetBool("server.tls.enabled") {
+		return nil, nil
+	}
+	config, err := common.NewTLSConfig(common.TLSOptions{
+		CAFile:     v.GetString("server.tls.caFile"),
+		CertFile:   v.GetString("server.tls.certFile"),
+		KeyFile:    v.GetString("server.tls.keyFile"),
+		ServerName: v.GetString("server.tls.serverName"),
+		MinVersion: v.GetString("server.tls.minVersion"),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not load the TLS configuration.")
+	}
+	return config, nil
+}
+
 // PrintConfig Print all the configuration parameters of the program.
 // For debugging purposes only
 func PrintConfig(v *viper.Viper) {
-	log.Infof("action: config | result: success | client_id: %s | server_address: %s | loop_amount: %v | loop_period: %v | log_level: %s",
-		v.GetString("id"),
-		v.GetString("server.address"),
-		v.GetInt("loop.amount"),
-		v.GetDuration("loop.period"),
-		v.GetString("log.level"),
+	log.Info("config", "success",
+		logger.F("client_id", v.GetString("id")),
+		logger.F("build_version", buildVersion),
+		logger.F("server_address", v.GetString("server.address")),
+		logger.F("connect_timeout", v.GetDuration("server.connectTimeout")),
+		logger.F("read_timeout", v.GetDuration("server.readTimeout")),
+		logger.F("write_timeout", v.GetDuration("server.writeTimeout")),
+		logger.F("tls_enabled", v.GetBool("server.tls.enabled")),
+		logger.F("tls_ca_file", v.GetString("server.tls.caFile")),
+		logger.F("tls_cert_file", v.GetString("server.tls.certFile")),
+		logger.F("tls_server_name", v.GetString("server.tls.serverName")),
+		logger.F("tls_min_version", v.GetString("server.tls.minVersion")),
+		logger.F("auth_secret_file", v.GetString("auth.secretFile")),
+		logger.F("connection_mode", v.GetString("connection.mode")),
+		logger.F("retry_max_attempts", v.GetInt("retry.maxAttempts")),
+		logger.F("loop_period", v.GetDuration("loop.period")),
+		logger.F("log_level", v.GetString("log.level")),
+		logger.F("log_format", v.GetString("log.format")),
+		logger.F("log_redact", v.GetString("log.redact")),
+		logger.F("max_frame_size", v.GetInt("protocol.maxFrameSize")),
+		logger.F("bets_file", v.GetString("bets.file")),
+		logger.F("invalid_bet_policy", v.GetString("bets.invalidPolicy")),
+		logger.F("checkpoint_file", v.GetString("checkpoint.file")),
+		logger.F("batch_max_amount", v.GetInt("batch.maxAmount")),
+		logger.F("batch_max_bytes", v.GetInt("batch.maxBytes")),
+		logger.F("batch_window", v.GetInt("batch.window")),
+		logger.F("batch_adaptive", v.GetBool("batch.adaptive")),
+		logger.F("batch_target_latency", v.GetDuration("batch.targetLatency")),
+		logger.F("batch_seq_file", v.GetString("batch.seqFile")),
+		logger.F("compression_enabled", v.GetBool("compression.enabled")),
+		logger.F("compression_threshold", v.GetInt("compression.threshold")),
+		logger.F("outbox_dir", v.GetString("outbox.dir")),
+		logger.F("outbox_fsync", v.GetString("outbox.fsync")),
+		logger.F("winners_timeout", v.GetDuration("winners.timeout")),
 	)
 }
 
 func main() {
+	restartFromScratch := flag.Bool("restart-from-scratch", false,
+		"ignore the stored checkpoint and send the bets file from the beginning")
+	flag.Parse()
+
+	rand.Seed(time.Now().UnixNano())
+
 	v, err := InitConfig()
 	if err != nil {
 		log.Criticalf("%s", err)
+		os.Exit(exitCodeConfig)
 	}
 
-	if err := InitLogger(v.GetString("log.level")); err != nil {
+	if err := InitLogger(v.GetString("log.level"), v.GetString("log.format")); err != nil {
 		log.Criticalf("%s", err)
+		os.Exit(exitCodeConfig)
 	}
+	common.SetLogRedaction(common.NewRedactor(common.RedactMode(v.GetString("log.redact")), v.GetString("log.redactSalt")))
 
 	// Print program config with debugging purposes
 	PrintConfig(v)
 
+	tlsConfig, err := InitTLS(v)
+	if err != nil {
+		log.Criticalf("%s", err)
+		os.Exit(exitCodeConfig)
+	}
+
+	var secret []byte
+	if path := v.GetString("auth.secretFile"); path != "" {
+		if secret, err = auth.LoadSecret(path); err != nil {
+			log.Criticalf("%s", errors.Wrapf(err, "Could not load CLI_AUTH_SECRETFILE."))
+			os.Exit(exitCodeConfig)
+		}
+	}
+
 	clientConfig := common.ClientConfig{
-		ServerAddress: v.GetString("server.address"),
-		ID:            v.GetString("id"),
-		LoopAmount:    v.GetInt("loop.amount"),
-		LoopPeriod:    v.GetDuration("loop.period"),
+		ServerAddress:  v.GetString("server.address"),
+		ID:             v.GetString("id"),
+		ConnectTimeout: v.GetDuration("server.connectTimeout"),
+		ReadTimeout:    v.GetDuration("server.readTimeout"),
+		WriteTimeout:   v.GetDuration("server.writeTimeout"),
+		TLS:            tlsConfig,
+		Secret:         secret,
+		BuildVersion:   buildVersion,
+		Retry: common.RetryPolicy{
+			MaxAttempts:    v.GetInt("retry.maxAttempts"),
+			InitialBackoff: v.GetDuration("retry.initialBackoff"),
+			MaxBackoff:     v.GetDuration("retry.maxBackoff"),
+			Jitter:         v.GetFloat64("retry.jitter"),
+		},
+		ConnectionMode: common.ConnectionMode(v.GetString("connection.mode")),
+		LoopPeriod:     v.GetDuration("loop.period"),
+		MaxFrameSize:   v.GetInt("protocol.maxFrameSize"),
+
+		BetsFile:         v.GetString("bets.file"),
+		InvalidBetPolicy: common.InvalidBetPolicy(v.GetString("bets.invalidPolicy")),
+		QuarantineFile:   v.GetString("bets.quarantineFile"),
+
+		CheckpointFile:     v.GetString("checkpoint.file"),
+		RestartFromScratch: *restartFromScratch,
+		SeqFile:            v.GetString("batch.seqFile"),
+
+		BatchMaxAmount: v.GetInt("batch.maxAmount"),
+		BatchMaxBytes:  v.GetInt("batch.maxBytes"),
+		BatchWindow:    v.GetInt("batch.window"),
+
+		BatchAdaptive:      v.GetBool("batch.adaptive"),
+		BatchTargetLatency: v.GetDuration("batch.targetLatency"),
+
+		CompressionEnabled:   v.GetBool("compression.enabled"),
+		CompressionThreshold: v.GetInt("compression.threshold"),
+
+		OutboxDir:         v.GetString("outbox.dir"),
+		OutboxFsync:       common.FsyncPolicy(v.GetString("outbox.fsync")),
+		OutboxSegmentSize: v.GetInt64("outbox.segmentSize"),
+
+		WinnersTimeout:        v.GetDuration("winners.timeout"),
+		WinnersInitialBackoff: v.GetDuration("winners.initialBackoff"),
+		WinnersMaxBackoff:     v.GetDuration("winners.maxBackoff"),
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	received := handleSignals(stop, v.GetString("id"))
+
+	client, err := common.NewClient(clientConfig)
+	if err != nil {
+		log.Criticalf("%s", err)
+		os.Exit(exitCodeConfig)
+	}
+	_, err = client.Run(ctx)
+
+	os.Exit(shutdownCode(received, err, v.GetString("id")))
+}
+
+// shutdownCode Returns the exit code of the program once the client
+// stopped. If it was stopped by a signal the code reports that signal,
+// otherwise it is mapped from the error returned by the client
+func shutdownCode(received <-chan os.Signal, err error, clientID string) int {
+	select {
+	case sig := <-received:
+		log.Info("shutdown", "success", logger.F("client_id", clientID), logger.F("signal", sig))
+		return signalExitCode(sig)
+	default:
+		return exitCode(err)
 	}
+}
+
+// signalExitCode Exit code of the program when it is stopped by the signal
+func signalExitCode(sig os.Signal) int {
+	return exitCodeSignalBase + int(sig.(syscall.Signal))
+}
+
+// exitCode Maps the error returned by the client to the exit code of the
+// program. Categories are checked from the most to the least specific one
+func exitCode(err error) int {
+	switch {
+	case err == nil:
+		return exitCodeSuccess
+	case errors.Is(err, common.ErrConfig):
+		return exitCodeConfig
+	case errors.Is(err, common.ErrInvalidBets):
+		return exitCodeInvalidBets
+	case errors.Is(err, common.ErrServerRejectedBatch):
+		return exitCodeRejectedBatch
+	case errors.Is(err, common.ErrProtocol):
+		return exitCodeProtocol
+	case errors.Is(err, common.ErrServerUnavailable):
+		return exitCodeUnavailable
+	case errors.Is(err, common.ErrTimeout):
+		return exitCodeTimeout
+	default:
+		return exitCodeUnknown
+	}
+}
+
+// handleSignals Cancels the client when SIGTERM or SIGINT is received. The
+// received signal is published in the returned channel. A second signal
+// exits right away, without waiting for the client to shut down
+func handleSignals(cancel context.CancelFunc, clientID string) <-chan os.Signal {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	return watchSignals(sigs, cancel, os.Exit, clientID)
+}
+
+// watchSignals Cancels the client on the first signal read from sigs,
+// publishing it in the returned channel, and calls exit with the exit code
+// of the second one
+func watchSignals(sigs <-chan os.Signal, cancel context.CancelFunc, exit func(int), clientID string) <-chan os.Signal {
+	received := make(chan os.Signal, 1)
+	go func() {
+		sig := <-sigs
+		log.Info("signal_received", "success", logger.F("client_id", clientID), logger.F("signal", sig))
+		received <- sig
+		cancel()
 
-	client := common.NewClient(clientConfig)
-	client.StartClientLoop()
+		sig = <-sigs
+		log.Warning("signal_received", "forced_exit", logger.F("client_id", clientID), logger.F("signal", sig))
+		exit(signalExitCode(sig))
+	}()
+	return received
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/protocol"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{name: "success", err: nil, expected: exitCodeSuccess},
+		{name: "config", err: errors.Wrap(common.ErrConfig, "invalid id"), expected: exitCodeConfig},
+		{name: "invalid bets", err: errors.Wrap(common.ErrInvalidBets, "line 3"), expected: exitCodeInvalidBets},
+		{name: "rejected batch", err: &common.ServerError{Request: protocol.MsgBatchBet, Reason: "invalid batch"}, expected: exitCodeRejectedBatch},
+		{name: "rejected hello", err: &common.ServerError{Request: protocol.MsgHello, Reason: "bad signature"}, expected: exitCodeConfig},
+		{name: "protocol", err: &common.UnexpectedResponseError{Request: protocol.MsgBatchBet, Expected: protocol.MsgAck, Got: protocol.MsgWinnersResult}, expected: exitCodeProtocol},
+		{name: "unavailable", err: &common.ConnectionLostError{Op: "receive_message", Err: io.EOF}, expected: exitCodeUnavailable},
+		{name: "timeout", err: &common.TimeoutError{Op: "receive_message", Err: context.DeadlineExceeded}, expected: exitCodeTimeout},
+		{name: "unknown", err: errors.New("unknown"), expected: exitCodeUnknown},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code := exitCode(test.err); code != test.expected {
+				t.Fatalf("expected exit code %d, got %d", test.expected, code)
+			}
+		})
+	}
+}
+
+func TestInitConfigRejectsCompressionThresholdAboveBatchBudget(t *testing.T) {
+	t.Setenv("CLI_COMPRESSION_ENABLED", "true")
+	t.Setenv("CLI_BATCH_MAXBYTES", "4096")
+	t.Setenv("CLI_COMPRESSION_THRESHOLD", "4096")
+	if _, err := InitConfig(); err == nil {
+		t.Fatal("expected a threshold equal to the batch budget to be rejected")
+	}
+
+	t.Setenv("CLI_COMPRESSION_THRESHOLD", "4095")
+	if _, err := InitConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestFirstSignalCancelsClientAndSetsExitCode(t *testing.T) {
+	sigs := make(chan os.Signal, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := watchSignals(sigs, cancel, func(code int) {
+		t.Errorf("unexpected forced exit with code %d", code)
+	}, "1")
+
+	sigs <- syscall.SIGTERM
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the signal to cancel the client")
+	}
+
+	code := shutdownCode(received, errors.Wrap(context.Canceled, "sending batch"), "1")
+	if expected := exitCodeSignalBase + int(syscall.SIGTERM); code != expected {
+		t.Fatalf("expected exit code %d, got %d", expected, code)
+	}
+}
+
+func TestSecondSignalForcesExit(t *testing.T) {
+	sigs := make(chan os.Signal, 2)
+	exits := make(chan int, 1)
+	watchSignals(sigs, func() {}, func(code int) { exits <- code }, "1")
+
+	sigs <- syscall.SIGTERM
+	sigs <- syscall.SIGINT
+	select {
+	case code := <-exits:
+		if expected := exitCodeSignalBase + int(syscall.SIGINT); code != expected {
+			t.Fatalf("expected exit code %d, got %d", expected, code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the second signal to force the exit")
+	}
+}
+
+func TestShutdownCodeWithoutSignalMapsError(t *testing.T) {
+	received := make(chan os.Signal, 1)
+	err := errors.Wrap(common.ErrInvalidBets, "line 3")
+	if code := shutdownCode(received, err, "1"); code != exitCodeInvalidBets {
+		t.Fatalf("expected exit code %d, got %d", exitCodeInvalidBets, code)
+	}
+}
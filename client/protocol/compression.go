@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// compressedFlag Bit of the kind byte of a message set when its payload is
+// compressed with deflate
+const compressedFlag = 0x80
+
+// finalBlock Empty final stored deflate block. Appended to a stream that
+// was sync flushed, it ends the stream right after the flushed data
+var finalBlock = []byte{0x01, 0x00, 0x00, 0xff, 0xff}
+
+// DecompressedTooLargeError Returned when a compressed payload expands
+// beyond the limit of the codec
+type DecompressedTooLargeError struct {
+	Max int
+}
+
+func (e *DecompressedTooLargeError) Error() string {
+	return fmt.Sprintf("compressed payload expands beyond %d bytes", e.Max)
+}
+
+// Deflate Compresses the data received as parameter in a single deflate
+// stream
+func Deflate(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Inflate Decompresses a deflate stream, failing with a
+// *DecompressedTooLargeError if it expands beyond max bytes
+func Inflate(data []byte, max int) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(data))
+	defer reader.Close()
+
+	inflated, err := io.ReadAll(io.LimitReader(reader, int64(max)+1))
+	if err != nil {
+		return nil, &MalformedMessageError{Reason: "invalid compressed payload: " + err.Error()}
+	}
+	if len(inflated) > max {
+		return nil, &DecompressedTooLargeError{Max: max}
+	}
+	return inflated, nil
+}
+
+// StreamCompressor Compresses data appended in chunks, knowing after every
+// chunk the exact size the deflate stream would have if it ended there.
+// Every chunk is sync flushed, so the last one can be undone by dropping
+// the bytes it added, which ends the stream
+type StreamCompressor struct {
+	buf      bytes.Buffer
+	writer   *flate.Writer
+	previous int
+	undone   bool
+}
+
+// NewStreamCompressor Initializes an empty stream
+func NewStreamCompressor() *StreamCompressor {
+	s := &StreamCompressor{}
+	// Lower levels emit small flushed chunks as stored blocks, which never
+	// reference earlier chunks. The level is valid, so NewWriter cannot fail
+	s.writer, _ = flate.NewWriter(&s.buf, flate.BestCompression)
+	return s
+}
+
+// Append Compresses the chunk and returns the size of the stream if it
+// ended after it
+func (s *StreamCompressor) Append(chunk []byte) (int, error) {
+	if s.undone {
+		return 0, errors.New("cannot append to a compressed stream after undoing a chunk")
+	}
+	s.previous = s.buf.Len()
+	if _, err := s.writer.Write(chunk); err != nil {
+		return 0, err
+	}
+	if err := s.writer.Flush(); err != nil {
+		return 0, err
+	}
+	return s.Size(), nil
+}
+
+// Undo Drops the last appended chunk. No chunk can be appended after it
+// until the stream is reset
+func (s *StreamCompressor) Undo() {
+	s.buf.Truncate(s.previous)
+	s.undone = true
+}
+
+// Size Size of the stream if it ended now
+func (s *StreamCompressor) Size() int {
+	return s.buf.Len() + len(finalBlock)
+}
+
+// Bytes Returns the ended stream
+func (s *StreamCompressor) Bytes() []byte {
+	stream := make([]byte, 0, s.Size())
+	stream = append(stream, s.buf.Bytes()...)
+	return append(stream, finalBlock...)
+}
+
+// Reset Discards the stream and starts a new one
+func (s *StreamCompressor) Reset() {
+	s.buf.Reset()
+	s.writer.Reset(&s.buf)
+	s.previous = 0
+	s.undone = false
+}
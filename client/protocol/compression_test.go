@@ -0,0 +1,50 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestStreamCompressorUndoEndsStreamAtPreviousChunk(t *testing.T) {
+	compressor := NewStreamCompressor()
+	chunk := []byte("Santiago Lionel,Lorca,30904465,1999-03-17,2201\n")
+
+	var size int
+	for i := 0; i < 3; i++ {
+		var err error
+		if size, err = compressor.Append(chunk); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if size != len(compressor.Bytes()) {
+		t.Fatalf("expected the stream to take %d bytes, got %d", size, len(compressor.Bytes()))
+	}
+
+	compressor.Append(bytes.Repeat([]byte{'x'}, 100))
+	compressor.Undo()
+	inflated, err := Inflate(compressor.Bytes(), 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(inflated, bytes.Repeat(chunk, 3)) {
+		t.Fatalf("expected the first 3 chunks, got %q", inflated)
+	}
+	if _, err := compressor.Append(chunk); err == nil {
+		t.Fatal("expected appending after undo to fail")
+	}
+}
+
+func TestInflateRejectsPayloadsAboveLimit(t *testing.T) {
+	compressed, err := Deflate(make([]byte, 4096))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = Inflate(compressed, 1024)
+	var tooLarge *DecompressedTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected *DecompressedTooLargeError, got %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Version Revision of the wire format. The client and the server agree on
+// one when the connection starts, so the format can change without
+// breaking agencies still running older binaries
+type Version byte
+
+// Versions of the wire format the client speaks
+const (
+	// Version1 Messages inside length prefixed packets, batches numbered per
+	// agency and optionally compressed
+	Version1 Version = 1
+
+	// MinVersion Oldest version the client speaks
+	MinVersion = Version1
+	// MaxVersion Newest version the client speaks
+	MaxVersion = Version1
+)
+
+// Feature Optional capability of a connection, agreed with the server when
+// the connection starts. Features are combined as a bit mask
+type Feature byte
+
+// Features the client may ask for
+const (
+	// FeatureCompression Batch payloads above a threshold may be compressed
+	FeatureCompression Feature = 1 << iota
+	// FeaturePipelining Several batches may be sent before their
+	// acknowledgements arrive
+	FeaturePipelining
+)
+
+// Has Returns true if every feature of other is in the mask
+func (f Feature) Has(other Feature) bool {
+	return f&other == other
+}
+
+// helloSize Size of the fixed fields of a Hello: minimum and maximum
+// version (1 byte each), agency id (4 bytes) and features (1 byte). The
+// build version of the client takes the rest of the payload
+const helloSize = 7
+
+// helloReplySize Size of a HelloReply: the selected version and the
+// accepted features (1 byte each)
+const helloReplySize = 2
+
+// Hello Payload of the MsgHello sent by the client: the range of versions
+// it speaks, its agency, the features it asks for and the version of its
+// build, used by the central to tell agencies on old binaries apart
+type Hello struct {
+	MinVersion Version
+	MaxVersion Version
+	Agency     uint32
+	Features   Feature
+	Build      string
+}
+
+// Serialize Returns the wire representation of the hello
+func (h Hello) Serialize() []byte {
+	buf := make([]byte, helloSize, helloSize+len(h.Build))
+	buf[0] = byte(h.MinVersion)
+	buf[1] = byte(h.MaxVersion)
+	binary.BigEndian.PutUint32(buf[2:6], h.Agency)
+	buf[6] = byte(h.Features)
+	return append(buf, h.Build...)
+}
+
+// DeserializeHello Decodes a hello previously encoded with Serialize
+func DeserializeHello(data []byte) (Hello, error) {
+	if len(data) < helloSize {
+		return Hello{}, &MalformedMessageError{
+			Reason: fmt.Sprintf("hello takes %d bytes, expected at least %d", len(data), helloSize),
+		}
+	}
+	hello := Hello{
+		MinVersion: Version(data[0]),
+		MaxVersion: Version(data[1]),
+		Agency:     binary.BigEndian.Uint32(data[2:6]),
+		Features:   Feature(data[6]),
+		Build:      string(data[helloSize:]),
+	}
+	if hello.MinVersion > hello.MaxVersion {
+		return Hello{}, &MalformedMessageError{
+			Reason: fmt.Sprintf("hello minimum version %d is greater than maximum %d", hello.MinVersion, hello.MaxVersion),
+		}
+	}
+	return hello, nil
+}
+
+// HelloReply Payload of the MsgHello the server answers with: the version
+// selected among the ones of the client and the features it accepts
+type HelloReply struct {
+	Version  Version
+	Features Feature
+}
+
+// Serialize Returns the wire representation of the reply
+func (r HelloReply) Serialize() []byte {
+	return []byte{byte(r.Version), byte(r.Features)}
+}
+
+// DeserializeHelloReply Decodes a reply previously encoded with Serialize
+func DeserializeHelloReply(data []byte) (HelloReply, error) {
+	if len(data) != helloReplySize {
+		return HelloReply{}, &MalformedMessageError{
+			Reason: fmt.Sprintf("hello reply takes %d bytes, expected %d", len(data), helloReplySize),
+		}
+	}
+	return HelloReply{Version: Version(data[0]), Features: Feature(data[1])}, nil
+}
+
+// Reply Answers the hello as a server speaking the versions between min
+// and max and supporting the features received as parameter would. ok is
+// false if no version is spoken by both sides
+func (h Hello) Reply(min Version, max Version, features Feature) (HelloReply, bool) {
+	version := h.MaxVersion
+	if max < version {
+		version = max
+	}
+	if version < min || version < h.MinVersion {
+		return HelloReply{}, false
+	}
+	return HelloReply{Version: version, Features: h.Features & features}, true
+}
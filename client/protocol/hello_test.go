@@ -0,0 +1,41 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestHelloRoundTrip(t *testing.T) {
+	hello := Hello{MinVersion: 1, MaxVersion: 3, Agency: 5, Features: FeatureCompression | FeaturePipelining, Build: "v1.0.0"}
+
+	decoded, err := DeserializeHello(hello.Serialize())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if decoded != hello {
+		t.Fatalf("expected %+v, got %+v", hello, decoded)
+	}
+
+	var malformed *MalformedMessageError
+	if _, err := DeserializeHello(hello.Serialize()[:helloSize-1]); !errors.As(err, &malformed) {
+		t.Fatalf("expected *MalformedMessageError for a truncated hello, got %v", err)
+	}
+}
+
+func TestHelloReplySelectsCommonVersion(t *testing.T) {
+	hello := Hello{MinVersion: 1, MaxVersion: 3, Features: FeatureCompression | FeaturePipelining}
+
+	reply, ok := hello.Reply(2, 2, FeatureCompression)
+	if !ok || reply.Version != 2 || reply.Features != FeatureCompression {
+		t.Fatalf("expected version 2 with compression, got %+v, %v", reply, ok)
+	}
+	if _, ok := hello.Reply(4, 5, 0); ok {
+		t.Fatal("expected no common version")
+	}
+
+	decoded, err := DeserializeHelloReply(reply.Serialize())
+	if err != nil || decoded != reply {
+		t.Fatalf("expected %+v, got %+v, %v", reply, decoded, err)
+	}
+}
@@ -0,0 +1,190 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MessageHeaderSize Size in bytes of the kind (1 byte) and the payload
+// length (4 bytes) that precede the payload of every message
+const MessageHeaderSize = 5
+
+// maxCompressionRatio How many times its frame a decompressed payload can
+// take
+const maxCompressionRatio = 16
+
+// MessageKind Identifies the meaning of the payload of a message
+type MessageKind byte
+
+// Kinds of messages exchanged between an agency and the central
+const (
+	// MsgBatchBet Agency id and batch sequence number followed by a batch of
+	// serialized bets
+	MsgBatchBet MessageKind = iota + 1
+	// MsgAgencyFinished The agency has sent every bet. Payload is the agency id
+	MsgAgencyFinished
+	// MsgWinnersQuery Asks for the winners of an agency. Payload is the agency id
+	MsgWinnersQuery
+	// MsgWinnersResult Documents of the winners of the agency, 4 bytes each
+	MsgWinnersResult
+	// MsgWinnersNotReady The draw has not happened yet, the query must be retried
+	MsgWinnersNotReady
+	// MsgError The request could not be processed. Payload is the reason
+	MsgError
+	// MsgAck The request was processed successfully. Batches are acknowledged
+	// with their sequence number as payload, optionally followed by the bets
+	// that were not stored: their index in the batch (2 bytes) and a reason
+	// code (1 byte) each
+	MsgAck
+	// MsgDuplicateBatch The batch had already been stored. Payload is its
+	// sequence number
+	MsgDuplicateBatch
+	// MsgHello First message of a connection. The client sends a Hello and
+	// the server answers with a HelloReply
+	MsgHello
+	// MsgSigned Another message signed by the agency with its shared
+	// secret. Payload is the agency id, a message sequence number, a
+	// timestamp, the signature and the signed message, as built by the auth
+	// package
+	MsgSigned
+)
+
+func (k MessageKind) String() string {
+	switch k {
+	case MsgBatchBet:
+		return "batch_bet"
+	case MsgAgencyFinished:
+		return "agency_finished"
+	case MsgWinnersQuery:
+		return "winners_query"
+	case MsgWinnersResult:
+		return "winners_result"
+	case MsgWinnersNotReady:
+		return "winners_not_ready"
+	case MsgError:
+		return "error"
+	case MsgAck:
+		return "ack"
+	case MsgDuplicateBatch:
+		return "duplicate_batch"
+	case MsgHello:
+		return "hello"
+	case MsgSigned:
+		return "signed"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(k))
+	}
+}
+
+// valid Returns true if the kind is one of the known kinds
+func (k MessageKind) valid() bool {
+	return k >= MsgBatchBet && k <= MsgSigned
+}
+
+// UnknownKindError Returned when a message of an unknown kind is decoded
+type UnknownKindError struct {
+	Kind byte
+}
+
+func (e *UnknownKindError) Error() string {
+	return fmt.Sprintf("unknown message kind %d", e.Kind)
+}
+
+// MalformedMessageError Returned when the bytes of a message are not
+// consistent with its header
+type MalformedMessageError struct {
+	Reason string
+}
+
+func (e *MalformedMessageError) Error() string {
+	return "malformed message: " + e.Reason
+}
+
+// Message Typed envelope of every exchange with the server. On the wire it
+// is a 1 byte kind, a 4 bytes big-endian payload length and the payload,
+// carried inside a Packet. The highest bit of the kind is set when the
+// payload is compressed with deflate
+type Message struct {
+	Kind       MessageKind
+	Payload    []byte
+	Compressed bool
+}
+
+// NewMessage Initializes a message of the kind received as parameter
+func NewMessage(kind MessageKind, payload []byte) Message {
+	return Message{Kind: kind, Payload: payload}
+}
+
+// NewCompressedMessage Initializes a message whose payload was already
+// compressed with deflate
+func NewCompressedMessage(kind MessageKind, compressed []byte) Message {
+	return Message{Kind: kind, Payload: compressed, Compressed: true}
+}
+
+// Serialize Returns the wire representation of the message
+func (m Message) Serialize() []byte {
+	buf := make([]byte, MessageHeaderSize+len(m.Payload))
+	buf[0] = byte(m.Kind)
+	if m.Compressed {
+		buf[0] |= compressedFlag
+	}
+	binary.BigEndian.PutUint32(buf[1:MessageHeaderSize], uint32(len(m.Payload)))
+	copy(buf[MessageHeaderSize:], m.Payload)
+	return buf
+}
+
+// DeserializeMessage Decodes a message previously encoded with Serialize.
+// Messages of unknown kinds are rejected with an *UnknownKindError
+func DeserializeMessage(data []byte) (Message, error) {
+	if len(data) < MessageHeaderSize {
+		return Message{}, &MalformedMessageError{
+			Reason: fmt.Sprintf("expected at least %d bytes, got %d", MessageHeaderSize, len(data)),
+		}
+	}
+
+	kind := MessageKind(data[0] &^ compressedFlag)
+	if !kind.valid() {
+		return Message{}, &UnknownKindError{Kind: data[0]}
+	}
+
+	length := int(binary.BigEndian.Uint32(data[1:MessageHeaderSize]))
+	if length != len(data)-MessageHeaderSize {
+		return Message{}, &MalformedMessageError{
+			Reason: fmt.Sprintf("header announces %d bytes of payload, got %d", length, len(data)-MessageHeaderSize),
+		}
+	}
+	message := NewMessage(kind, data[MessageHeaderSize:])
+	message.Compressed = data[0]&compressedFlag != 0
+	return message, nil
+}
+
+// WriteMessage Writes the message to w inside a single packet
+func (c *Codec) WriteMessage(w io.Writer, m Message) error {
+	return c.WritePacket(w, NewPacket(m.Serialize()))
+}
+
+// ReadMessage Reads a packet from r and decodes it as a message. Compressed
+// payloads are returned decompressed
+func (c *Codec) ReadMessage(r io.Reader) (Message, error) {
+	packet, err := c.ReadPacket(r)
+	if err != nil {
+		return Message{}, err
+	}
+	message, err := DeserializeMessage(packet.Payload)
+	if err != nil || !message.Compressed {
+		return message, err
+	}
+
+	payload, err := Inflate(message.Payload, c.maxDecompressedSize())
+	if err != nil {
+		return Message{}, err
+	}
+	return NewMessage(message.Kind, payload), nil
+}
+
+// maxDecompressedSize Limit to the size of a decompressed payload, so a
+// small frame cannot expand without bounds
+func (c *Codec) maxDecompressedSize() int {
+	return maxCompressionRatio * c.maxFrameSize
+}
@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestMessageRoundTripThroughCodec(t *testing.T) {
+	codec := NewCodec(0)
+	var buf bytes.Buffer
+
+	sent := NewMessage(MsgWinnersQuery, []byte{0, 0, 0, 1})
+	if err := codec.WriteMessage(&buf, sent); err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+
+	received, err := codec.ReadMessage(&buf)
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+	if received.Kind != sent.Kind || !bytes.Equal(received.Payload, sent.Payload) {
+		t.Fatalf("expected %+v, got %+v", sent, received)
+	}
+}
+
+func TestDeserializeMessageRejectsUnknownKind(t *testing.T) {
+	data := NewMessage(MsgAck, nil).Serialize()
+	data[0] = 0xFF
+
+	_, err := DeserializeMessage(data)
+	var unknown *UnknownKindError
+	if !errors.As(err, &unknown) || unknown.Kind != 0xFF {
+		t.Fatalf("expected *UnknownKindError, got %v", err)
+	}
+}
+
+func TestDeserializeMessageRejectsLengthMismatch(t *testing.T) {
+	data := NewMessage(MsgError, []byte("boom")).Serialize()
+
+	_, err := DeserializeMessage(data[:len(data)-1])
+	var malformed *MalformedMessageError
+	if !errors.As(err, &malformed) {
+		t.Fatalf("expected *MalformedMessageError, got %v", err)
+	}
+}
+
+func TestCompressedMessageIsInflatedWhenRead(t *testing.T) {
+	codec := NewCodec(0)
+	payload := bytes.Repeat([]byte("Santiago Lionel,Lorca,30904465,1999-03-17,2201\n"), 50)
+	compressed, err := Deflate(payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := codec.WriteMessage(&buf, NewCompressedMessage(MsgBatchBet, compressed)); err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+	received, err := codec.ReadMessage(&buf)
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+	if received.Kind != MsgBatchBet || received.Compressed || !bytes.Equal(received.Payload, payload) {
+		t.Fatalf("expected the decompressed batch, got %v with %d bytes", received.Kind, len(received.Payload))
+	}
+}
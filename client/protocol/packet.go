@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// HeaderSize Size in bytes of the length header that precedes every frame.
+// The header holds the payload length as a big-endian unsigned integer
+const HeaderSize = 4
+
+// DefaultMaxFrameSize Maximum size in bytes (header included) of a frame
+// when no other limit is configured
+const DefaultMaxFrameSize = 8 * 1024
+
+// TruncatedFrameError Returned when the peer closes the connection in the
+// middle of a frame
+type TruncatedFrameError struct {
+	Expected int
+	Received int
+}
+
+func (e *TruncatedFrameError) Error() string {
+	return fmt.Sprintf("truncated frame: expected %d bytes, received %d", e.Expected, e.Received)
+}
+
+// FrameTooLargeError Returned when a frame exceeds the maximum frame size,
+// either when it is about to be written or when its header is read
+type FrameTooLargeError struct {
+	Size int
+	Max  int
+}
+
+func (e *FrameTooLargeError) Error() string {
+	return fmt.Sprintf("frame too large: %d bytes exceeds the limit of %d bytes", e.Size, e.Max)
+}
+
+// Packet Framed unit of data exchanged with the server. On the wire it is
+// a fixed size length header followed by the payload
+type Packet struct {
+	Payload []byte
+}
+
+// NewPacket Wraps the payload received as parameter in a Packet
+func NewPacket(payload []byte) Packet {
+	return Packet{Payload: payload}
+}
+
+// Size Amount of bytes the packet takes on the wire, header included
+func (p Packet) Size() int {
+	return HeaderSize + len(p.Payload)
+}
+
+// Serialize Returns the wire representation of the packet
+func (p Packet) Serialize() []byte {
+	buf := make([]byte, p.Size())
+	binary.BigEndian.PutUint32(buf[:HeaderSize], uint32(len(p.Payload)))
+	copy(buf[HeaderSize:], p.Payload)
+	return buf
+}
+
+// WriteFull Writes the whole buffer to w, retrying on short writes until
+// every byte has been written or an error occurs
+func WriteFull(w io.Writer, data []byte) error {
+	written := 0
+	for written < len(data) {
+		n, err := w.Write(data[written:])
+		written += n
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+	}
+	return nil
+}
+
+// ReadFull Reads from r until buf is completely filled, retrying on short
+// reads. The amount of bytes read is returned. If r is exhausted before any
+// byte is read io.EOF is returned, and io.ErrUnexpectedEOF if it happens
+// after a partial read
+func ReadFull(r io.Reader, buf []byte) (int, error) {
+	read := 0
+	for read < len(buf) {
+		n, err := r.Read(buf[read:])
+		read += n
+		if err == io.EOF {
+			if read == 0 {
+				return 0, io.EOF
+			}
+			if read < len(buf) {
+				return read, io.ErrUnexpectedEOF
+			}
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// Codec Writes and reads packets enforcing a maximum frame size
+type Codec struct {
+	maxFrameSize int
+}
+
+// NewCodec Initializes a codec with the maximum frame size received as
+// parameter. Non positive values fall back to DefaultMaxFrameSize
+func NewCodec(maxFrameSize int) *Codec {
+	if maxFrameSize <= 0 {
+		maxFrameSize = DefaultMaxFrameSize
+	}
+	return &Codec{maxFrameSize: maxFrameSize}
+}
+
+// MaxFrameSize Maximum size in bytes (header included) of a frame
+func (c *Codec) MaxFrameSize() int {
+	return c.maxFrameSize
+}
+
+// WritePacket Serializes the packet and writes it to w. Packets larger than
+// the maximum frame size are rejected before anything is written
+func (c *Codec) WritePacket(w io.Writer, p Packet) error {
+	if p.Size() > c.maxFrameSize {
+		return &FrameTooLargeError{Size: p.Size(), Max: c.maxFrameSize}
+	}
+	return WriteFull(w, p.Serialize())
+}
+
+// ReadPacket Reads a whole packet from r. io.EOF is returned if the peer
+// closed the connection before sending a new frame
+func (c *Codec) ReadPacket(r io.Reader) (Packet, error) {
+	header := make([]byte, HeaderSize)
+	if n, err := ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Packet{}, &TruncatedFrameError{Expected: HeaderSize, Received: n}
+		}
+		if err == io.EOF {
+			return Packet{}, err
+		}
+		return Packet{}, errors.Wrap(err, "could not read packet header")
+	}
+
+	length := int(binary.BigEndian.Uint32(header))
+	if HeaderSize+length > c.maxFrameSize {
+		return Packet{}, &FrameTooLargeError{Size: HeaderSize + length, Max: c.maxFrameSize}
+	}
+
+	payload := make([]byte, length)
+	if n, err := ReadFull(r, payload); err != nil {
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return Packet{}, &TruncatedFrameError{Expected: length, Received: n}
+		}
+		return Packet{}, errors.Wrap(err, "could not read packet payload")
+	}
+	return NewPacket(payload), nil
+}
@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// chunkedReader Returns at most one byte per Read call to force short reads
+type chunkedReader struct {
+	r io.Reader
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return c.r.Read(p)
+}
+
+// chunkedWriter Accepts at most one byte per Write call to force short writes
+type chunkedWriter struct {
+	buf bytes.Buffer
+}
+
+func (c *chunkedWriter) Write(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return c.buf.Write(p)
+}
+
+func TestPacketRoundTripSurvivesShortReadsAndWrites(t *testing.T) {
+	codec := NewCodec(0)
+	payload := []byte("[CLIENT 1] Message N°1\nwith a newline")
+
+	w := &chunkedWriter{}
+	if err := codec.WritePacket(w, NewPacket(payload)); err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+
+	p, err := codec.ReadPacket(&chunkedReader{r: &w.buf})
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+	if !bytes.Equal(p.Payload, payload) {
+		t.Fatalf("expected payload %q, got %q", payload, p.Payload)
+	}
+}
+
+func TestWritePacketRejectsOversizedFrame(t *testing.T) {
+	codec := NewCodec(16)
+	var buf bytes.Buffer
+
+	err := codec.WritePacket(&buf, NewPacket(make([]byte, 13)))
+	var tooLarge *FrameTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected FrameTooLargeError, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing to be written, got %d bytes", buf.Len())
+	}
+}
+
+func TestReadPacketRejectsOversizedHeader(t *testing.T) {
+	wire := NewPacket(make([]byte, 32)).Serialize()
+
+	_, err := NewCodec(16).ReadPacket(bytes.NewReader(wire))
+	var tooLarge *FrameTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected FrameTooLargeError, got %v", err)
+	}
+}
+
+func TestReadPacketReportsTruncatedFrame(t *testing.T) {
+	wire := NewPacket([]byte("hello")).Serialize()
+
+	_, err := NewCodec(0).ReadPacket(bytes.NewReader(wire[:len(wire)-2]))
+	var truncated *TruncatedFrameError
+	if !errors.As(err, &truncated) {
+		t.Fatalf("expected TruncatedFrameError, got %v", err)
+	}
+	if truncated.Expected != 5 || truncated.Received != 3 {
+		t.Fatalf("unexpected truncation details: %+v", truncated)
+	}
+}
+
+func TestReadPacketReturnsEOFOnClosedConnection(t *testing.T) {
+	_, err := NewCodec(0).ReadPacket(bytes.NewReader(nil))
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+import collections
+import hashlib
+import hmac
+import struct
+import time
+
+
+""" Kind of the message that wraps a signed message. """
+MSG_SIGNED = 10
+""" Bit of the kind byte set when the payload is compressed. """
+COMPRESSED_FLAG = 0x80
+""" Size in bytes of the kind and the length of the payload of a message. """
+MESSAGE_HEADER_SIZE = 5
+""" Agency id (4 bytes), sequence number (8 bytes) and timestamp in milliseconds (8 bytes). """
+SIGNED_HEADER = struct.Struct('>IQQ')
+""" Size in bytes of the HMAC-SHA256 signature. """
+SIGNATURE_SIZE = hashlib.sha256().digest_size
+""" Default maximum difference in seconds between the timestamp of a message and the clock of the central. """
+DEFAULT_WINDOW = 30.0
+
+
+class AuthError(Exception):
+    """ A signed message could not be verified """
+
+
+class MalformedMessage(AuthError):
+    """ The message does not follow the format of a signed message """
+
+
+class UnknownAgency(AuthError):
+    """ The agency of the message has no secret """
+
+
+class BadSignature(AuthError):
+    """ The signature does not match the message """
+
+
+class StaleMessage(AuthError):
+    """ The timestamp of the message is out of the window """
+
+
+class ReplayedMessage(AuthError):
+    """ The message was already verified """
+
+
+""" A verified message and the data it was signed with. The carried message keeps its payload as it was sent. """
+Envelope = collections.namedtuple('Envelope', ['agency', 'seq', 'timestamp_ms', 'kind', 'compressed', 'payload'])
+
+
+def parse_message(data: bytes):
+    """
+    Decodes a serialized message
+
+    Returns its kind, whether its payload is compressed and the payload.
+    MalformedMessage is raised if the length in the header does not match
+    the data
+    """
+    if len(data) < MESSAGE_HEADER_SIZE:
+        raise MalformedMessage(f'expected at least {MESSAGE_HEADER_SIZE} bytes, got {len(data)}')
+    length = struct.unpack('>I', data[1:MESSAGE_HEADER_SIZE])[0]
+    if length != len(data) - MESSAGE_HEADER_SIZE:
+        raise MalformedMessage(f'header announces {length} bytes of payload, got {len(data) - MESSAGE_HEADER_SIZE}')
+    return data[0] & ~COMPRESSED_FLAG, bool(data[0] & COMPRESSED_FLAG), data[MESSAGE_HEADER_SIZE:]
+
+
+def signature(secret: bytes, header: bytes, signed: bytes) -> bytes:
+    """ HMAC-SHA256 of the header and the signed message """
+    return hmac.new(secret, header + signed, hashlib.sha256).digest()
+
+
+class Verifier:
+    def __init__(self, secrets, window=DEFAULT_WINDOW, now=time.time):
+        """
+        Verifies the signed messages the agencies send to the central
+
+        secrets maps every agency id to its secret. Messages whose
+        timestamp differs from the clock of the central in more than
+        window seconds are rejected, and so are messages already verified
+        within it. Reference implementation of auth.Verifier of the client
+        """
+        self._secrets = secrets
+        self._window_ms = int(window * 1000)
+        self._now = now
+        self._seen = set()
+        # Verified messages in the order they were verified, so the ones
+        # that left the window are forgotten from the oldest
+        self._order = collections.deque()
+
+    def verify(self, data: bytes) -> Envelope:
+        """
+        Checks the serialized signed message and returns the message it carries
+
+        An AuthError is raised if the message cannot be verified
+        """
+        kind, _, payload = parse_message(data)
+        if kind != MSG_SIGNED:
+            raise BadSignature(f'message of kind {kind} is not signed')
+        if len(payload) < SIGNED_HEADER.size + SIGNATURE_SIZE:
+            raise MalformedMessage(
+                f'signed message takes {len(payload)} bytes, expected at least {SIGNED_HEADER.size + SIGNATURE_SIZE}')
+
+        header = payload[:SIGNED_HEADER.size]
+        agency, seq, timestamp_ms = SIGNED_HEADER.unpack(header)
+        secret = self._secrets.get(agency)
+        if secret is None:
+            raise UnknownAgency(f'agency {agency}')
+        signed = payload[SIGNED_HEADER.size + SIGNATURE_SIZE:]
+        if not hmac.compare_digest(payload[SIGNED_HEADER.size:SIGNED_HEADER.size + SIGNATURE_SIZE],
+                                   signature(secret, header, signed)):
+            raise BadSignature(f'message {seq} of agency {agency}')
+
+        self.__remember((agency, seq, timestamp_ms))
+        inner_kind, compressed, inner_payload = parse_message(signed)
+        return Envelope(agency, seq, timestamp_ms, inner_kind, compressed, inner_payload)
+
+    def __remember(self, key):
+        """
+        Records the message as verified
+
+        Raises StaleMessage if its timestamp is out of the window and
+        ReplayedMessage if it was already verified. Messages that left the
+        window are forgotten, since their timestamp alone rejects them
+        """
+        now_ms = int(self._now() * 1000)
+        while self._order and now_ms - self._order[0][2] > self._window_ms:
+            self._seen.discard(self._order.popleft())
+
+        agency, seq, timestamp_ms = key
+        if abs(now_ms - timestamp_ms) > self._window_ms:
+            raise StaleMessage(f'message {seq} of agency {agency} is {now_ms - timestamp_ms} ms away from now')
+        if key in self._seen:
+            raise ReplayedMessage(f'message {seq} of agency {agency}')
+        self._seen.add(key)
+        self._order.append(key)
@@ -0,0 +1,70 @@
+from common.auth import *
+import json
+import os
+import unittest
+
+""" Signed messages shared with the tests of the auth package of the client. """
+VECTORS_FILEPATH = os.path.join(os.path.dirname(__file__), 'auth_vectors.json')
+
+ERRORS = {
+    'malformed': MalformedMessage,
+    'unknown_agency': UnknownAgency,
+    'bad_signature': BadSignature,
+    'stale': StaleMessage,
+}
+
+
+class TestAuth(unittest.TestCase):
+
+    def setUp(self):
+        with open(VECTORS_FILEPATH) as file:
+            self.vectors = json.load(file)
+
+    def _verifier(self, now_ms):
+        secrets = {int(agency): secret.encode('utf-8') for agency, secret in self.vectors['secrets'].items()}
+        return Verifier(secrets, self.vectors['window_ms'] / 1000, lambda: now_ms / 1000)
+
+    def test_verify_matches_vectors(self):
+        for vector in self.vectors['vectors']:
+            with self.subTest(vector['name']):
+                verifier = self._verifier(vector['now_ms'])
+                message = bytes.fromhex(vector['message'])
+                if vector['result'] != 'ok':
+                    with self.assertRaises(ERRORS[vector['result']]):
+                        verifier.verify(message)
+                    continue
+
+                envelope = verifier.verify(message)
+                inner = bytes.fromhex(vector['inner'])
+                self.assertEqual(vector['agency'], envelope.agency)
+                self.assertEqual(vector['seq'], envelope.seq)
+                self.assertEqual(vector['timestamp_ms'], envelope.timestamp_ms)
+                self.assertEqual(parse_message(inner), (envelope.kind, envelope.compressed, envelope.payload))
+
+    def test_verify_rejects_replayed_message(self):
+        vector = self.vectors['vectors'][0]
+        verifier = self._verifier(vector['now_ms'])
+        message = bytes.fromhex(vector['message'])
+        verifier.verify(message)
+        with self.assertRaises(ReplayedMessage):
+            verifier.verify(message)
+
+    def test_verify_forgets_only_messages_out_of_the_window(self):
+        vector = self.vectors['vectors'][0]
+        now_ms = vector['now_ms']
+        verifier = Verifier({1: b'agency-secret'}, self.vectors['window_ms'] / 1000, lambda: now_ms / 1000)
+        message = bytes.fromhex(vector['message'])
+        verifier.verify(message)
+
+        # Still within the window, so it is still remembered
+        now_ms = vector['timestamp_ms'] + self.vectors['window_ms']
+        with self.assertRaises(ReplayedMessage):
+            verifier.verify(message)
+
+        now_ms += 1
+        with self.assertRaises(StaleMessage):
+            verifier.verify(message)
+
+
+if __name__ == '__main__':
+    unittest.main()